@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"net/http"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jeremyletang/babakoto_api/utils"
+)
+
+// AuditEvents are the routes to read the audit log, they must be used with
+// the admin permission
+type AuditEvents struct {
+	repos dao.Repositories
+}
+
+func NewAuditEvents(repos dao.Repositories) AuditEvents {
+	return AuditEvents{repos: repos}
+}
+
+// List return a page of the audit events, the latest first by default, see
+// dao.AuditEventList for the filters
+func (aa *AuditEvents) List(w http.ResponseWriter, r *http.Request) {
+	page, perr := pagination.Parse(r.URL.Query(), dao.AuditEventList)
+	if perr != nil {
+		utils.WriteJsonResponse(w, http.StatusBadRequest, perr.Fail())
+		return
+	}
+	es, next, err := aa.repos.AuditEvents.List(page)
+	if err != nil {
+		log.Errorf("[admin.AuditEvents.List] unable to list audit events: %s", err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+	utils.WriteJsonResponse(w, http.StatusOK, pagination.Response("audit_events", es, next))
+}
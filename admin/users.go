@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+
+	log "github.com/cihub/seelog"
+	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jeremyletang/babakoto_api/services/audit"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
+	"github.com/jeremyletang/babakoto_api/utils"
+)
+
+// Users are the routes to manage the other users, they must be used with
+// the admin permission
+type Users struct {
+	repos dao.Repositories
+	cache *authcache.Cache
+}
+
+func NewUsers(repos dao.Repositories, cache *authcache.Cache) Users {
+	return Users{repos: repos, cache: cache}
+}
+
+// List return a page of the users which are not deleted, see dao.UserList
+// for the sorts and the filters
+func (ua *Users) List(w http.ResponseWriter, r *http.Request) {
+	page, perr := pagination.Parse(r.URL.Query(), dao.UserList)
+	if perr != nil {
+		utils.WriteJsonResponse(w, http.StatusBadRequest, perr.Fail())
+		return
+	}
+	us, next, err := ua.repos.Users.List(page)
+	if err != nil {
+		log.Errorf("[admin.Users.List] unable to list users: %s", err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+	utils.WriteJsonResponse(w, http.StatusOK, pagination.Response("users", us, next))
+}
+
+// Restore undo the deletion of a user which is not purged yet, his access
+// tokens were revoked so he has to login again
+func (ua *Users) Restore(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	// the restored user is read back, not from a replica
+	repos := ua.repos.Session()
+
+	if err := repos.Users.Restore(id); err != nil {
+		if !errors.Is(err, dao.ErrNotFound) {
+			log.Errorf("[admin.Users.Restore] unable to restore user [id=%s]: %s", id, err.Error())
+		}
+		utils.WriteError(w, err)
+		return
+	}
+	ua.cache.InvalidateUser(id)
+	u, err := repos.Users.GetById(id)
+	if err != nil {
+		log.Errorf("[admin.Users.Restore] unable to get restored user [id=%s]: %s", id, err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+
+	if admin, ok := ctxext.ExtractUser(r.Context()); ok {
+		log.Infof("[admin.Users.Restore] user [id=%s] restored by [id=%s]", id, admin.Id)
+		audit.Record(r.Context(), repos, domain.AuditUserRestore, admin.Id, id)
+	}
+	w.Header().Set("ETag", utils.ETag(u.Version))
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.WithName(u, "user"))
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/satori/go.uuid"
+)
+
+// TokenConfig hold the lifetimes in seconds of the tokens created on login
+// and signup, the defaults are set by the config package
+type TokenConfig struct {
+	AccessTokenTtl        int `json:"access_token_ttl"`
+	SignupVerificationTtl int `json:"signup_verification_ttl"`
+}
+
+// LoginLimit bound the login attempts by identifier over a window of
+// seconds, disabled when MaxAttempts is 0. The default window is set by the
+// config package.
+type LoginLimit struct {
+	MaxAttempts int `json:"max_attempts"`
+	Window      int `json:"window"`
+}
+
+// GenerateAccessToken create and save a new access token for the user u,
+// the token is valid for ttl seconds. The other tokens of the user are kept
+// until they expire, then the janitor remove them.
+func GenerateAccessToken(repos dao.Repositories, u domain.User, ttl int) (domain.AccessToken, error) {
+	// each login open a new session, the existing tokens stay valid
+	newToken := domain.NewAccessToken(uuid.NewV4().String(), u.Id, ttl, time.Now())
+
+	if err := repos.AccessTokens.Create(newToken); err != nil {
+		log.Errorf("[auth.GenerateAccessToken] unable to save token: %s", err.Error())
+		return newToken, err
+	}
+
+	metrics.TokensIssued.Inc()
+	return newToken, nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/utils"
+)
+
+const realm = "babakoto"
+
+// TokenError is a failure to authenticate the request with its access token,
+// Reason is returned in the jsend failure so clients can tell them apart
+type TokenError struct {
+	Reason      string
+	Description string
+}
+
+var (
+	ErrMissingToken   = &TokenError{"missing", "Missing access token"}
+	ErrMalformedToken = &TokenError{"malformed", "Malformed authorization header"}
+	ErrInvalidToken   = &TokenError{"invalid", "Invalid access token"}
+	ErrExpiredToken   = &TokenError{"expired", "The access token expired"}
+	ErrNoUserLinked   = &TokenError{"invalid", "Invalid access token (no user linked)"}
+	ErrUnverifiedUser = &TokenError{"unverified", "Cannot use a non verified user"}
+)
+
+func (e *TokenError) Error() string {
+	return e.Description
+}
+
+// Write the failure with the status and the WWW-Authenticate challenge
+// described in RFC 6750 section 3
+func (e *TokenError) Write(w http.ResponseWriter) {
+	status := http.StatusUnauthorized
+	switch e.Reason {
+	case ErrMissingToken.Reason:
+		// no error code when the request has no authentication at all
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, realm))
+	case ErrMalformedToken.Reason:
+		status = http.StatusBadRequest
+		w.Header().Set("WWW-Authenticate", challenge("invalid_request", e.Description))
+	case ErrUnverifiedUser.Reason:
+		// the token is valid, the user is not allowed yet
+		status = http.StatusForbidden
+	default:
+		w.Header().Set("WWW-Authenticate", challenge("invalid_token", e.Description))
+	}
+
+	data := map[string]interface{}{}
+	data["access_token"] = e.Description
+	data["reason"] = e.Reason
+	utils.WriteJsonResponse(w, status, jsend.Fail(data))
+}
+
+func challenge(code, description string) string {
+	return fmt.Sprintf(`Bearer realm="%s", error="%s", error_description="%s"`,
+		realm, code, description)
+}
+
+// the b64token syntax from RFC 6750 section 2.1
+func isB64Token(token string) bool {
+	end := strings.TrimRight(token, "=")
+	for _, c := range end {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~', c == '+', c == '/':
+		default:
+			return false
+		}
+	}
+	return len(end) > 0
+}
+
+// GetBearerToken extract the access token from the Authorization header using
+// the Bearer scheme. The access_token query or form parameter is only read if
+// allowQuery is set as it ends in the logs and the browser history.
+func GetBearerToken(r *http.Request, allowQuery bool) (string, *TokenError) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", ErrMalformedToken
+		}
+		token := strings.TrimSpace(parts[1])
+		if !isB64Token(token) {
+			return "", ErrMalformedToken
+		}
+		return token, nil
+	}
+
+	if allowQuery {
+		if err := r.ParseForm(); err != nil {
+			return "", ErrMalformedToken
+		}
+		if token := r.Form.Get("access_token"); token != "" {
+			return token, nil
+		}
+	}
+
+	return "", ErrMissingToken
+}
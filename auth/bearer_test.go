@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetBearerToken(t *testing.T) {
+	for _, c := range []struct {
+		header   string
+		expected string
+		err      *TokenError
+	}{
+		{"Bearer abc", "abc", nil},
+		// the scheme is case insensitive
+		{"bearer abc", "abc", nil},
+		{"BEARER abc", "abc", nil},
+		{"  Bearer   abc  ", "abc", nil},
+		{"Bearer a-b.c_d~e+f/g==", "a-b.c_d~e+f/g==", nil},
+		{"Bearer", "", ErrMalformedToken},
+		{"Bearer ", "", ErrMalformedToken},
+		{"Bearer    ", "", ErrMalformedToken},
+		{"Bearer ===", "", ErrMalformedToken},
+		{"Bearer a b", "", ErrMalformedToken},
+		{"Bearer a,b", "", ErrMalformedToken},
+		{"Bearer a=b", "", ErrMalformedToken},
+		{"Basic YWxpY2U6c2VjcmV0", "", ErrMalformedToken},
+		{"Bearerabc", "", ErrMalformedToken},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", c.header)
+		token, err := GetBearerToken(r, false)
+		if token != c.expected || err != c.err {
+			t.Fatalf("%q: expected %q %v, got %q %v", c.header, c.expected, c.err, token, err)
+		}
+	}
+}
+
+func TestGetBearerTokenQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?access_token=abc", nil)
+	if _, err := GetBearerToken(r, false); err != ErrMissingToken {
+		t.Fatalf("expected the query to be ignored, got %v", err)
+	}
+	if token, err := GetBearerToken(r, true); token != "abc" || err != nil {
+		t.Fatalf("expected the token of the query, got %q %v", token, err)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("access_token=abc"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token, err := GetBearerToken(r, true); token != "abc" || err != nil {
+		t.Fatalf("expected the token of the form, got %q %v", token, err)
+	}
+
+	// the header come first
+	r = httptest.NewRequest("GET", "/?access_token=abc", nil)
+	r.Header.Set("Authorization", "Bearer def")
+	if token, err := GetBearerToken(r, true); token != "def" || err != nil {
+		t.Fatalf("expected the token of the header, got %q %v", token, err)
+	}
+	if _, err := GetBearerToken(httptest.NewRequest("GET", "/", nil), true); err != ErrMissingToken {
+		t.Fatalf("expected %v, got %v", ErrMissingToken, err)
+	}
+}
+
+func TestTokenErrorWrite(t *testing.T) {
+	for _, c := range []struct {
+		err       *TokenError
+		status    int
+		challenge string
+	}{
+		// no error code without authentication
+		{ErrMissingToken, http.StatusUnauthorized, `Bearer realm="babakoto"`},
+		{ErrMalformedToken, http.StatusBadRequest,
+			`Bearer realm="babakoto", error="invalid_request", error_description="Malformed authorization header"`},
+		{ErrInvalidToken, http.StatusUnauthorized,
+			`Bearer realm="babakoto", error="invalid_token", error_description="Invalid access token"`},
+		{ErrExpiredToken, http.StatusUnauthorized,
+			`Bearer realm="babakoto", error="invalid_token", error_description="The access token expired"`},
+		{ErrUnverifiedUser, http.StatusForbidden, ""},
+	} {
+		w := httptest.NewRecorder()
+		c.err.Write(w)
+		if w.Code != c.status || w.Header().Get("WWW-Authenticate") != c.challenge {
+			t.Fatalf("%s: expected %d %q, got %d %q", c.err.Reason, c.status, c.challenge,
+				w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		data, _ := body["data"].(map[string]interface{})
+		if body["status"] != "fail" || data["reason"] != c.err.Reason {
+			t.Fatalf("%s: unexpected body %v", c.err.Reason, body)
+		}
+	}
+}
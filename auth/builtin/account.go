@@ -0,0 +1,321 @@
+package builtinauth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jeremyletang/babakoto_api/services/audit"
+	"github.com/jeremyletang/babakoto_api/services/user"
+	"github.com/jeremyletang/babakoto_api/session"
+	"github.com/jeremyletang/babakoto_api/utils"
+	"github.com/jeremyletang/babakoto_api/utils/errmsg"
+	"github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+// ProfileRequest is a partial update, the missing fields are unchanged
+type ProfileRequest struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// Session is an access token as shown to its user, the token itself is a
+// secret so it is replaced by a hash
+type Session struct {
+	Id        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// the token used for this request
+	Current bool `json:"current"`
+}
+
+func newSession(at domain.AccessToken, current string) Session {
+	return Session{
+		Id:        fmt.Sprintf("%x", sha256.Sum256([]byte(at.Id)))[:16],
+		CreatedAt: at.CreatedAt,
+		ExpiresAt: at.ExpiresAt,
+		Current:   at.Id == current,
+	}
+}
+
+// wasVerified tell if the user verified his account once, his pending
+// verification if any is then an email change
+func wasVerified(repos dao.Repositories, userId string) (bool, error) {
+	usv, err := repos.SignupVerifications.GetByUserId(userId)
+	if errors.Is(err, dao.ErrNotFound) {
+		return true, nil
+	}
+	return usv.EmailChange, err
+}
+
+func passwordValidator(p *PasswordRequest) map[string]interface{} {
+	errors := map[string]interface{}{}
+	if p.CurrentPassword == "" {
+		errors["current_password"] = errmsg.MissingFieldError
+	}
+	if p.Password == "" {
+		errors["password"] = errmsg.MissingFieldError
+	}
+	return errors
+}
+
+// ChangePassword replace the password of the logged user, every access token
+// of the user is revoked and a new one is returned
+func (ba *BuiltinAuth) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := ctxext.ExtractUser(r.Context())
+	if !ok {
+		log.Errorf("[builtinauth.ChangePassword] no user in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	var req PasswordRequest
+	if err := utils.ReadRequestBody(r, &req); err != nil {
+		log.Errorf("[builtinauth.ChangePassword] invalid request body: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail("invalid json"))
+		return
+	}
+	if err := passwordValidator(&req); len(err) != 0 {
+		log.Errorf("[builtinauth.ChangePassword] validation error: %#v", err)
+		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail(err))
+		return
+	}
+
+	if !utils.CheckIfMatch(w, r, u.Version) {
+		return
+	}
+
+	// the users coming from an external provider have no password to change
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.CurrentPassword)); err != nil {
+		log.Errorf("[builtinauth.ChangePassword] invalid password for user [id=%s]", u.Id)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName(errmsg.InvalidPassword, "current_password"))
+		return
+	}
+
+	cryptedPassword, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	u.Password = string(cryptedPassword)
+	u.UpdatedAt = time.Now()
+
+	userId := u.Id
+	var at domain.AccessToken
+	err := ba.repos.WithTx(func(tx dao.Repositories) error {
+		var err error
+		if u, err = tx.Users.Update(u); err != nil {
+			return err
+		}
+		// log out the other sessions, they may be the reason of the change
+		if err := tx.AccessTokens.DeleteByUserId(u.Id); err != nil {
+			return err
+		}
+		at, err = auth.GenerateAccessToken(tx, u, ba.tokens.AccessTokenTtl)
+		return err
+	})
+	// the token store may not be part of the transaction, the tokens can be
+	// revoked even if it failed
+	ba.cache.InvalidateUser(userId)
+	if err != nil {
+		log.Errorf("[builtinauth.ChangePassword] unable to change password of user [id=%s]: %s",
+			userId, err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+
+	// the session cookie hold the revoked token
+	if ba.sessions.Enabled {
+		session.ClearCookies(w, ba.sessions)
+	}
+	audit.Record(r.Context(), ba.repos, domain.AuditPasswordChange, u.Id, u.Id)
+
+	u.Password = ""
+	res := map[string]interface{}{}
+	res["access_token"] = at
+	res["user"] = u
+	w.Header().Set("ETag", utils.ETag(u.Version))
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(res))
+}
+
+// UpdateProfile change the username or the email of the logged user, the
+// user has to verify a new email again
+func (ba *BuiltinAuth) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	u, ok := ctxext.ExtractUser(r.Context())
+	if !ok {
+		log.Errorf("[builtinauth.UpdateProfile] no user in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	var req ProfileRequest
+	if err := utils.ReadRequestBody(r, &req); err != nil {
+		log.Errorf("[builtinauth.UpdateProfile] invalid request body: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail("invalid json"))
+		return
+	}
+	if !utils.CheckIfMatch(w, r, u.Version) {
+		return
+	}
+
+	// only check what change, the user already use his own email
+	errors := map[string]interface{}{}
+	emailChanged := req.Email != nil && *req.Email != u.Email
+	if req.Username != nil && *req.Username != u.Username {
+		if *req.Username == "" {
+			errors["username"] = errmsg.MissingFieldError
+		} else if used, err := ba.repos.Users.IsUsernameUsed(*req.Username); err != nil {
+			log.Errorf("[builtinauth.UpdateProfile] unable to check username: %s", err.Error())
+			utils.WriteError(w, err)
+			return
+		} else if used {
+			errors["username"] = errmsg.UsernameAlreadyUsed
+		}
+		u.Username = *req.Username
+	}
+	if emailChanged {
+		if *req.Email == "" {
+			errors["email"] = errmsg.MissingFieldError
+		} else if used, err := ba.repos.Users.IsEmailUsed(*req.Email); err != nil {
+			log.Errorf("[builtinauth.UpdateProfile] unable to check email: %s", err.Error())
+			utils.WriteError(w, err)
+			return
+		} else if used {
+			errors["email"] = errmsg.MailAlreadyUsed
+		}
+		u.Email = *req.Email
+	}
+	if len(errors) != 0 {
+		log.Errorf("[builtinauth.UpdateProfile] validation error: %#v", errors)
+		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail(errors))
+		return
+	}
+	u.UpdatedAt = time.Now()
+
+	res := map[string]interface{}{}
+	err := ba.repos.WithTx(func(tx dao.Repositories) error {
+		var err error
+		if u, err = tx.Users.Update(u); err != nil {
+			return err
+		}
+		if !emailChanged {
+			return nil
+		}
+		// a user who never verified his account is still purged if he do not
+		// verify the new email in time, a verified one is not
+		verified, err := wasVerified(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		// replace the pending verification if any
+		if err := tx.SignupVerifications.DeleteByUserId(u.Id); err != nil {
+			return err
+		}
+		usv := domain.NewUserSignupVerification(uuid.NewV4().String(), u.Id,
+			ba.tokens.SignupVerificationTtl, time.Now())
+		usv.EmailChange = verified
+		res["signup_verification"] = usv
+		return tx.SignupVerifications.Create(usv)
+	})
+	if err != nil {
+		log.Errorf("[builtinauth.UpdateProfile] unable to update user [id=%s]: %s", u.Id, err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+	ba.cache.InvalidateUser(u.Id)
+	audit.Record(r.Context(), ba.repos, domain.AuditProfileUpdate, u.Id, u.Id)
+
+	u.Password = ""
+	res["user"] = u
+	w.Header().Set("ETag", utils.ETag(u.Version))
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(res))
+}
+
+// DeleteAccount delete the logged user and revoke his access tokens, an admin
+// can restore him until he is purged. The password is asked again unless the
+// user come from an external provider
+func (ba *BuiltinAuth) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	u, ok := ctxext.ExtractUser(r.Context())
+	if !ok {
+		log.Errorf("[builtinauth.DeleteAccount] no user in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	if u.Password != "" {
+		var req DeleteAccountRequest
+		if err := utils.ReadRequestBody(r, &req); err != nil {
+			log.Errorf("[builtinauth.DeleteAccount] invalid request body: %s", err.Error())
+			utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail("invalid json"))
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)); err != nil {
+			log.Errorf("[builtinauth.DeleteAccount] invalid password for user [id=%s]", u.Id)
+			utils.WriteJsonResponse(w, http.StatusBadRequest,
+				jsend.FailWithName(errmsg.InvalidPassword, "password"))
+			return
+		}
+	}
+
+	err := user.Delete(ba.repos, u.Id)
+	// as for the password change the tokens can be revoked even on failure
+	ba.cache.InvalidateUser(u.Id)
+	if err != nil {
+		log.Errorf("[builtinauth.DeleteAccount] unable to delete user [id=%s]: %s", u.Id, err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+
+	if ba.sessions.Enabled {
+		session.ClearCookies(w, ba.sessions)
+	}
+	log.Infof("[builtinauth.DeleteAccount] user [id=%s] deleted", u.Id)
+	audit.Record(r.Context(), ba.repos, domain.AuditAccountDelete, u.Id, u.Id)
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(nil))
+}
+
+// Sessions return a page of the access tokens of the logged user, the
+// latest first by default
+func (ba *BuiltinAuth) Sessions(w http.ResponseWriter, r *http.Request) {
+	at, ok := ctxext.ExtractAccessToken(r.Context())
+	if !ok {
+		log.Errorf("[builtinauth.Sessions] no access token in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	page, perr := pagination.Parse(r.URL.Query(), dao.AccessTokenList)
+	if perr != nil {
+		utils.WriteJsonResponse(w, http.StatusBadRequest, perr.Fail())
+		return
+	}
+	ats, next, err := ba.repos.AccessTokens.List(page.With("access_tokens.user_id", at.UserId))
+	if err != nil {
+		log.Errorf("[builtinauth.Sessions] unable to list access tokens of user [id=%s]: %s",
+			at.UserId, err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+
+	sessions := []Session{}
+	for _, other := range ats {
+		sessions = append(sessions, newSession(other, at.Id))
+	}
+	utils.WriteJsonResponse(w, http.StatusOK, pagination.Response("sessions", sessions, next))
+}
@@ -0,0 +1,278 @@
+package builtinauth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	adminapi "github.com/jeremyletang/babakoto_api/admin"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/janitor"
+	"github.com/jeremyletang/babakoto_api/middleware"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
+	"github.com/jeremyletang/babakoto_api/session"
+)
+
+func TestUpdateProfile(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	verify(ba, verifId)
+	signup(t, ba, "bob@example.com", "bob", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+	update := authenticated(repos, ba.UpdateProfile)
+
+	w, body := serve(update, newRequest("PATCH", "/api/v1/user", `{"username":"alice2"}`, token))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected 200 with the next etag, got %d %q: %v", w.Code, w.Header().Get("ETag"), body)
+	}
+	if u, _ := repos.Users.GetById(userId); u.Username != "alice2" || u.Email != "alice@example.com" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	// changed since version 1 was read
+	r := newRequest("PATCH", "/api/v1/user", `{"username":"alice3"}`, token)
+	r.Header.Set("If-Match", `"1"`)
+	if w, body := serve(update, r); w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected 412, got %d: %v", w.Code, body)
+	}
+
+	w, body = serve(update, newRequest("PATCH", "/api/v1/user", `{"username":"bob","email":"bob@example.com"}`, token))
+	if w.Code != http.StatusBadRequest || data(body)["username"] == nil || data(body)["email"] == nil {
+		t.Fatalf("expected 400 on username and email, got %d: %v", w.Code, body)
+	}
+	if u, _ := repos.Users.GetById(userId); u.Username != "alice2" || u.Version != 2 {
+		t.Fatalf("the user must not change, got %+v", u)
+	}
+}
+
+// concurrent update the user once loaded by the middlewares, as another
+// request would before the handler write
+func concurrent(repos dao.Repositories) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, _ := ctxext.ExtractUser(r.Context())
+			repos.Users.Update(u)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, _ := signup(t, ba, "alice@example.com", "alice", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+	other := loginToken(t, ba, "alice", "secret")
+	change := authenticated(repos, ba.ChangePassword)
+
+	w, body := serve(change, newRequest("PUT", "/api/v1/user/password", `{"current_password":"wrong","password":"other"}`, token))
+	if w.Code != http.StatusBadRequest || data(body)["current_password"] == nil {
+		t.Fatalf("expected 400 on the current password, got %d: %v", w.Code, body)
+	}
+	// changed since version 0
+	r := newRequest("PUT", "/api/v1/user/password", `{"current_password":"secret","password":"other"}`, token)
+	r.Header.Set("If-Match", `"0"`)
+	if w, body := serve(change, r); w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("expected 412, got %d: %v", w.Code, body)
+	}
+
+	r = newRequest("PUT", "/api/v1/user/password", `{"current_password":"secret","password":"other"}`, token)
+	r.Header.Set("If-Match", `"1"`)
+	w, body = serve(change, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` || data(body)["access_token"] == nil {
+		t.Fatalf("expected 200 with a new token and the next etag, got %d %q: %v", w.Code, w.Header().Get("ETag"), body)
+	}
+	// every session is logged out
+	for _, revoked := range []string{token, other} {
+		if _, err := repos.AccessTokens.GetById(revoked); err == nil {
+			t.Fatalf("expected the token to be revoked")
+		}
+	}
+	if w, body := login(ba, "alice", "other"); w.Code != http.StatusOK {
+		t.Fatalf("expected to login with the new password, got %d: %v", w.Code, body)
+	}
+	if u, _ := repos.Users.GetById(userId); u.Version != 2 {
+		t.Fatalf("unexpected user %+v", u)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, _ := signup(t, ba, "alice@example.com", "alice", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+
+	for _, c := range []struct {
+		handler      http.HandlerFunc
+		method, path string
+		body         string
+	}{
+		{ba.ChangePassword, "PUT", "/api/v1/user/password", `{"current_password":"secret","password":"other"}`},
+		{ba.UpdateProfile, "PATCH", "/api/v1/user", `{"username":"alice2"}`},
+	} {
+		h := middleware.Chain(c.handler,
+			middleware.Authenticate(false, session.Config{}),
+			middleware.LoadUser(repos, nil),
+			concurrent(repos))
+		// without If-Match the update is still conditional on the version read
+		if w, body := serve(h, newRequest(c.method, c.path, c.body, token)); w.Code != http.StatusConflict {
+			t.Fatalf("%s %s: expected 409, got %d: %v", c.method, c.path, w.Code, body)
+		}
+	}
+	if u, _ := repos.Users.GetById(userId); u.Username != "alice" {
+		t.Fatalf("the user must not change, got %+v", u)
+	}
+	if _, err := repos.AccessTokens.GetById(token); err != nil {
+		t.Fatalf("the sessions must be kept when the password is not changed: %s", err)
+	}
+}
+
+func TestUpdateProfileEmail(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	verify(ba, verifId)
+	token := loginToken(t, ba, "alice", "secret")
+
+	w, body := serve(authenticated(repos, ba.UpdateProfile),
+		newRequest("PATCH", "/api/v1/user", `{"email":"alice@example.org"}`, token))
+	if w.Code != http.StatusOK || data(body)["signup_verification"] == nil {
+		t.Fatalf("expected 200 with a verification, got %d: %v", w.Code, body)
+	}
+	if u, _ := repos.Users.GetById(userId); u.Email != "alice@example.org" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	// the new email has to be verified
+	if w, _ := serve(verified(repos, ba.TokenInfos), newRequest("GET", "/api/v1/user/token-infos", "", token)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 until the email is verified, got %d", w.Code)
+	}
+	newVerifId := data(body)["signup_verification"].(map[string]interface{})["id"].(string)
+	verify(ba, newVerifId)
+	if w, _ := serve(verified(repos, ba.TokenInfos), newRequest("GET", "/api/v1/user/token-infos", "", token)); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 once verified, got %d", w.Code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	signup(t, ba, "alice@example.com", "alice", "secret")
+	signup(t, ba, "bob@example.com", "bob", "secret")
+	loginToken(t, ba, "alice", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+	loginToken(t, ba, "bob", "secret")
+
+	w, body := serve(authenticated(repos, ba.Sessions), newRequest("GET", "/api/v1/user/sessions", "", token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+	sessions := data(body)["sessions"].([]interface{})
+	if len(sessions) != 2 {
+		t.Fatalf("expected the 2 sessions of alice, got %v", sessions)
+	}
+	current := 0
+	for _, s := range sessions {
+		s := s.(map[string]interface{})
+		if s["id"] == token {
+			t.Fatalf("the token must not be shown")
+		}
+		if s["current"] == true {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Fatalf("expected one current session, got %v", sessions)
+	}
+
+	w, body = serve(authenticated(repos, ba.Sessions), newRequest("GET", "/api/v1/user/sessions?limit=1", "", token))
+	if w.Code != http.StatusOK || len(data(body)["sessions"].([]interface{})) != 1 || data(body)["next_cursor"] == nil {
+		t.Fatalf("expected a page of one session with a cursor, got %d: %v", w.Code, body)
+	}
+}
+
+func TestUpdateProfileEmailJanitor(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	verify(ba, verifId)
+	unverifiedId, _ := signup(t, ba, "bob@example.com", "bob", "secret")
+	for _, c := range []struct{ identifier, email string }{
+		{"alice", "alice@example.org"},
+		{"bob", "bob@example.org"},
+	} {
+		token := loginToken(t, ba, c.identifier, "secret")
+		w, body := serve(authenticated(repos, ba.UpdateProfile),
+			newRequest("PATCH", "/api/v1/user", `{"email":"`+c.email+`"}`, token))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", w.Code, body)
+		}
+	}
+
+	// the new email of alice is not verified in time
+	if _, err := janitor.Run(repos, janitor.Config{}, janitor.PurgeSignups, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Users.GetById(userId); err != nil {
+		t.Fatalf("a verified user must not be purged: %s", err)
+	}
+	// bob never verified his account
+	if _, err := repos.Users.GetById(unverifiedId); err == nil {
+		t.Fatalf("expected the unverified user to be purged")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	verify(ba, verifId)
+	token := loginToken(t, ba, "alice", "secret")
+	del := authenticated(repos, ba.DeleteAccount)
+
+	w, body := serve(del, newRequest("DELETE", "/api/v1/user", `{"password":"wrong"}`, token))
+	if w.Code != http.StatusBadRequest || data(body)["password"] == nil {
+		t.Fatalf("expected 400 on the password, got %d: %v", w.Code, body)
+	}
+	if w, body := serve(del, newRequest("DELETE", "/api/v1/user", `{"password":"secret"}`, token)); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+
+	// the tokens are revoked and the user cannot login
+	if w, _ := serve(del, newRequest("DELETE", "/api/v1/user", `{"password":"secret"}`, token)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a revoked token, got %d", w.Code)
+	}
+	if w, body := login(ba, "alice", "secret"); w.Code != http.StatusBadRequest || data(body)["login"] != "unable to login" {
+		t.Fatalf("expected the login to be refused, got %d: %v", w.Code, body)
+	}
+	// the username stays reserved until the user is purged
+	w, body = serve(http.HandlerFunc(ba.Signup), newRequest("POST", "/api/v1/user/signup",
+		`{"email":"alice@example.com","username":"alice","password":"other"}`, ""))
+	if w.Code != http.StatusBadRequest || data(body)["email"] == nil || data(body)["username"] == nil {
+		t.Fatalf("expected 400 on email and username, got %d: %v", w.Code, body)
+	}
+
+	users := adminapi.NewUsers(repos, nil)
+	r := mux.SetURLVars(newRequest("POST", "/api/v1/admin/users/"+userId+"/restore", "", ""),
+		map[string]string{"id": userId})
+	if w, body := serve(http.HandlerFunc(users.Restore), r); w.Code != http.StatusOK {
+		t.Fatalf("expected the user to be restored, got %d: %v", w.Code, body)
+	}
+	if w, body := login(ba, "alice", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected the restored user to login, got %d: %v", w.Code, body)
+	}
+}
+
+func TestDeleteAccountCache(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	ba.cache = authcache.New(authcache.Config{Enabled: true}, authcache.NewMemoryPubSub())
+	signup(t, ba, "alice@example.com", "alice", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+	del := middleware.Chain(http.HandlerFunc(ba.DeleteAccount),
+		middleware.Authenticate(false, session.Config{}),
+		middleware.LoadUser(repos, ba.cache))
+
+	if w, body := serve(del, newRequest("DELETE", "/api/v1/user", `{"password":"secret"}`, token)); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+	// the token was cached by the first request, it must not outlive the revocation
+	if w, _ := serve(del, newRequest("DELETE", "/api/v1/user", `{"password":"secret"}`, token)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a revoked token, got %d", w.Code)
+	}
+}
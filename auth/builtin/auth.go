@@ -1,41 +1,65 @@
 package builtinauth
 
 import (
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/auth"
 	"github.com/jeremyletang/babakoto_api/ctxext"
 	"github.com/jeremyletang/babakoto_api/dao"
 	"github.com/jeremyletang/babakoto_api/domain"
 	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/services/audit"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
+	"github.com/jeremyletang/babakoto_api/session"
 	"github.com/jeremyletang/babakoto_api/utils"
 	"github.com/jeremyletang/babakoto_api/utils/errmsg"
-	"github.com/jinzhu/gorm"
 	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const (
-	// seconds for a day
-	defaultUserSignupVerificationTtl = 86400
-	// accesstoken = two days
-	defaultAccessTokenTtl = 172800
-)
-
 type BuiltinAuth struct {
-	db *gorm.DB
+	repos    dao.Repositories
+	provider auth.Provider
+	cache    *authcache.Cache
+	sessions session.Config
+	tokens   auth.TokenConfig
+	limit    auth.LoginLimit
 }
 
-func NewBuiltinAuth(db *gorm.DB) BuiltinAuth {
-	return BuiltinAuth{db: db}
+// NewBuiltinAuth create the builtin auth routes, the login use provider to
+// authenticate the users so they can come from another backend than the builtin one.
+// The changes of the users and their tokens are invalidated in cache.
+func NewBuiltinAuth(
+	repos dao.Repositories,
+	provider auth.Provider,
+	cache *authcache.Cache,
+	sessions session.Config,
+	tokens auth.TokenConfig,
+	limit auth.LoginLimit,
+) BuiltinAuth {
+	return BuiltinAuth{
+		repos:    repos,
+		provider: provider,
+		cache:    cache,
+		sessions: sessions,
+		tokens:   tokens,
+		limit:    limit,
+	}
 }
 
 type LoginRequest struct {
 	Identifier string `json:"identifier"`
 	Password   string `json:"password"`
+	// browsers can ask for a session cookie instead of using the token
+	Session bool `json:"session"`
 }
 
 type SignupRequest struct {
@@ -55,94 +79,146 @@ func loginValidator(l *LoginRequest) map[string]interface{} {
 	return errors
 }
 
-func generateAccessToken(db *gorm.DB, u domain.User) (domain.AccessToken, error) {
-	// if access token exist just delete it and return a new one
-	tokenDao := dao.NewAccessTokenDao(db)
-	if _, err := tokenDao.GetByUserId(u.Id); err == nil {
-		log.Infof("[builtinauth.generateAccessToken] access token for user [id=%s] already exist, delete it", u.Id)
-	}
-
-	newToken := domain.AccessToken{
-		Id:        uuid.NewV4().String(),
-		UserId:    u.Id,
-		Ttl:       defaultAccessTokenTtl,
-		CreatedAt: time.Now(),
-	}
-
-	if err := tokenDao.Create(newToken); err != nil {
-		log.Errorf("[builtinauth.generateAccessToken] unable to save token: %s", err.Error())
-		return newToken, err
+// tooManyAttempts count the login attempt and tell if it is over the limit
+func (ba *BuiltinAuth) tooManyAttempts(identifier string) (bool, error) {
+	if ba.limit.MaxAttempts <= 0 {
+		return false, nil
 	}
-
-	return newToken, nil
+	// the identifier can be an email, it is not stored in clear
+	sum := sha256.Sum256([]byte(identifier))
+	n, err := ba.repos.Counters.Incr("login:"+hex.EncodeToString(sum[:]),
+		time.Duration(ba.limit.Window)*time.Second)
+	return n > int64(ba.limit.MaxAttempts), err
 }
 
 func (ba *BuiltinAuth) Login(w http.ResponseWriter, r *http.Request) {
 	var login LoginRequest
 	if err := utils.ReadRequestBody(r, &login); err != nil {
 		log.Errorf("[builtinauth.Login] invalid request body: %s", err.Error())
+		metrics.LoginFailed(metrics.ReasonInvalidRequest)
 		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail("invalid json"))
 	} else {
 		// validation error
 		if err := loginValidator(&login); len(err) != 0 {
 			log.Errorf("[builtinauth.Login] validation error: %#v", err)
+			metrics.LoginFailed(metrics.ReasonInvalidRequest)
 			utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail(err))
 			return
 		}
 
+		if limited, err := ba.tooManyAttempts(login.Identifier); err != nil {
+			log.Errorf("[builtinauth.Login] unable to count login attempts: %s", err.Error())
+			metrics.LoginFailed(metrics.ReasonInternalError)
+			utils.WriteError(w, err)
+			return
+		} else if limited {
+			log.Errorf("[builtinauth.Login] too many login attempts")
+			metrics.LoginFailed(metrics.ReasonRateLimited)
+			w.Header().Set("Retry-After", strconv.Itoa(ba.limit.Window))
+			utils.WriteJsonResponse(w, http.StatusTooManyRequests,
+				jsend.FailWithName("too many login attempts", "login"))
+			return
+		}
+
 		// request is good let's process it
-		// first get the user
-		userDao := dao.NewUserDao(ba.db)
-		u, err := userDao.GetByEmailOrUsername(login.Identifier)
-		if err != nil {
-			log.Errorf("[builtinauth.Login] unknow identifier: %s", login.Identifier)
+		u, err := ba.provider.Authenticate(auth.Credentials{
+			Identifier: login.Identifier,
+			Password:   login.Password,
+		})
+		switch err {
+		case nil:
+		case auth.ErrUnknownIdentifier:
+			metrics.LoginFailed(metrics.ReasonUnknownIdentifier)
 			utils.WriteJsonResponse(w, http.StatusBadRequest,
 				jsend.FailWithName("unable to login", "login"))
 			return
-		}
-
-		// try to match the password
-		if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(login.Password)); err != nil {
-			log.Errorf("[builtinauth.Login] invalid password for identifier: %s", login.Identifier)
+		case auth.ErrInvalidCredentials:
+			metrics.LoginFailed(metrics.ReasonInvalidCredentials)
 			utils.WriteJsonResponse(w, http.StatusBadRequest,
 				jsend.FailWithName("unable to login", "login"))
 			return
+		case auth.ErrAccountDeleted:
+			metrics.LoginFailed(metrics.ReasonAccountDeleted)
+			utils.WriteJsonResponse(w, http.StatusBadRequest,
+				jsend.FailWithName("unable to login", "login"))
+			return
+		case auth.ErrEmailAlreadyUsed:
+			metrics.LoginFailed(metrics.ReasonEmailAlreadyUsed)
+			utils.WriteJsonResponse(w, http.StatusBadRequest,
+				jsend.FailWithName(errmsg.MailAlreadyUsed, "email"))
+			return
+		default:
+			metrics.LoginFailed(metrics.ReasonInternalError)
+			utils.WriteError(w, err)
+			return
 		}
 
-		// password have matched, generate or regenerate the access_token
-		at, err := generateAccessToken(ba.db, u)
+		// credentials have matched, generate or regenerate the access_token
+		at, err := auth.GenerateAccessToken(ba.repos, u, ba.tokens.AccessTokenTtl)
 		if err != nil {
-			utils.WriteJsonResponse(w, http.StatusInternalServerError,
-				jsend.Error("internal error"))
+			metrics.LoginFailed(metrics.ReasonInternalError)
+			utils.WriteError(w, err)
+			return
 		}
 
 		// hide password for now
 		u.Password = ""
 		res := map[string]interface{}{}
-		res["access_token"] = at
 		res["user"] = u
 
+		if login.Session && ba.sessions.Enabled {
+			csrfToken, err := session.SetCookies(w, ba.sessions, at)
+			if err != nil {
+				log.Errorf("[builtinauth.Login] unable to create session: %s", err.Error())
+				metrics.LoginFailed(metrics.ReasonInternalError)
+				utils.WriteJsonResponse(w, http.StatusInternalServerError,
+					jsend.Error("internal error"))
+				return
+			}
+			// the token stay in the HttpOnly cookie, out of reach of the scripts
+			res["csrf_token"] = csrfToken
+		} else {
+			res["access_token"] = at
+		}
+
+		metrics.LoginSucceeded()
+		audit.Record(r.Context(), ba.repos, domain.AuditLogin, u.Id, u.Id)
 		utils.WriteJsonResponse(w, http.StatusOK,
 			jsend.New(res))
 	}
 }
-func (ba *BuiltinAuth) Logout(
-	ctx context.Context,
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	if token, ok := ctxext.ExtractAccessToken(ctx); ok {
-		tokenDao := dao.NewAccessTokenDao(ba.db)
-		if err := tokenDao.Delete(token.Id); err != nil && err != gorm.ErrRecordNotFound {
-			utils.WriteJsonResponse(w, http.StatusInternalServerError,
-				jsend.Error("database error"))
-			return
-		} else {
-			utils.WriteJsonResponse(w, http.StatusOK, jsend.New(nil))
-		}
-	} else {
-		utils.WriteJsonResponse(w, http.StatusOK, jsend.Error("internal error"))
+
+// Logout revoke the access token of the request. GET is kept for the
+// clients sending their token, the csrf token is not checked on a GET so it
+// is refused with the session cookie.
+func (ba *BuiltinAuth) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && ctxext.FromSessionCookie(r.Context()) {
+		w.Header().Set("Allow", "POST")
+		utils.WriteJsonResponse(w, http.StatusMethodNotAllowed,
+			jsend.Fail("use POST to logout a session"))
+		return
 	}
+
+	// the session is closed even if the token is already gone
+	if ba.sessions.Enabled {
+		session.ClearCookies(w, ba.sessions)
+	}
+
+	token, ok := ctxext.ExtractAccessToken(r.Context())
+	if !ok {
+		log.Errorf("[builtinauth.Logout] no access token in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	tokenDao := ba.repos.AccessTokens
+	if err := tokenDao.Delete(token.Id); err != nil && !errors.Is(err, dao.ErrNotFound) {
+		log.Errorf("[builtinauth.Logout] unable to delete access token: %s", err.Error())
+		utils.WriteError(w, err)
+		return
+	}
+	ba.cache.InvalidateToken(token.Id)
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(nil))
 }
 
 func signupValidator(l *SignupRequest) map[string]interface{} {
@@ -159,16 +235,25 @@ func signupValidator(l *SignupRequest) map[string]interface{} {
 	return errors
 }
 
-func checkExistsByEmailOrUsername(db *gorm.DB, email, username string) map[string]interface{} {
+// checkExistsByEmailOrUsername include the deleted users, their email and
+// username are reserved until they are purged
+func checkExistsByEmailOrUsername(repos dao.Repositories, email, username string) (map[string]interface{}, error) {
 	errors := map[string]interface{}{}
-	userDao := dao.NewUserDao(db)
-	if _, err := userDao.GetByMail(email); err == nil {
-		errors[email] = errmsg.MailAlreadyUsed
+	userDao := repos.Users
+	used, err := userDao.IsEmailUsed(email)
+	if err != nil {
+		return errors, err
 	}
-	if _, err := userDao.GetByUsername(username); err == nil {
-		errors[username] = errmsg.UsernameAlreadyUsed
+	if used {
+		errors["email"] = errmsg.MailAlreadyUsed
 	}
-	return errors
+	if used, err = userDao.IsUsernameUsed(username); err != nil {
+		return errors, err
+	}
+	if used {
+		errors["username"] = errmsg.UsernameAlreadyUsed
+	}
+	return errors, nil
 }
 
 func (ba *BuiltinAuth) Signup(w http.ResponseWriter, r *http.Request) {
@@ -186,9 +271,13 @@ func (ba *BuiltinAuth) Signup(w http.ResponseWriter, r *http.Request) {
 
 		// request is good let's process it
 		// first check if a user with this username or email already exist
-		if err := checkExistsByEmailOrUsername(ba.db, signup.Email, signup.Username); len(err) != 0 {
-			log.Errorf("[builtinauth.Signup] user data already exists: %#v", err)
-			utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail(err))
+		if exists, err := checkExistsByEmailOrUsername(ba.repos, signup.Email, signup.Username); err != nil {
+			log.Errorf("[builtinauth.Signup] unable to check existing users: %s", err.Error())
+			utils.WriteError(w, err)
+			return
+		} else if len(exists) != 0 {
+			log.Errorf("[builtinauth.Signup] user data already exists: %#v", exists)
+			utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail(exists))
 			return
 		}
 
@@ -202,31 +291,27 @@ func (ba *BuiltinAuth) Signup(w http.ResponseWriter, r *http.Request) {
 			Password:  string(cryptedPassword),
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
-		}
-
-		// save user
-		userDao := dao.NewUserDao(ba.db)
-		if err := userDao.Create(newUser); err != nil {
-			log.Errorf("[builtinauth.Signup] unable to create a new user: %s", error.Error)
-			utils.WriteJsonResponse(w, http.StatusInternalServerError,
-				jsend.Error("database error"))
-			return
+			Version:   1,
 		}
 
 		// create and save user signup verification request
-		userSignupVerif := domain.UserSignupVerification{
-			Id:        uuid.NewV4().String(),
-			UserId:    newUser.Id,
-			Ttl:       defaultUserSignupVerificationTtl,
-			CreatedAt: time.Now(),
-		}
-
-		// save verif
-		signupDao := dao.NewUserSignupVerificationDao(ba.db)
-		if err := signupDao.Create(userSignupVerif); err != nil {
-			log.Errorf("[builtinauth.Signup] unable to create user verification: %s", error.Error)
-			utils.WriteJsonResponse(w, http.StatusInternalServerError,
-				jsend.Error("database error"))
+		userSignupVerif := domain.NewUserSignupVerification(uuid.NewV4().String(), newUser.Id,
+			ba.tokens.SignupVerificationTtl, time.Now())
+
+		// save both or none, a user without verification would be verified
+		err := ba.repos.WithTx(func(tx dao.Repositories) error {
+			if err := tx.Users.Create(newUser); err != nil {
+				log.Errorf("[builtinauth.Signup] unable to create a new user: %s", err.Error())
+				return err
+			}
+			if err := tx.SignupVerifications.Create(userSignupVerif); err != nil {
+				log.Errorf("[builtinauth.Signup] unable to create user verification: %s", err.Error())
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			utils.WriteError(w, err)
 			return
 		}
 
@@ -234,6 +319,8 @@ func (ba *BuiltinAuth) Signup(w http.ResponseWriter, r *http.Request) {
 		res := map[string]interface{}{}
 		res["user"] = newUser
 		res["signup_verification"] = userSignupVerif
+		metrics.Signups.WithLabelValues("builtin").Inc()
+		audit.Record(r.Context(), ba.repos, domain.AuditSignup, newUser.Id, newUser.Id)
 		utils.WriteJsonResponse(w, http.StatusOK, jsend.New(res))
 	}
 }
@@ -243,32 +330,55 @@ func (ba *BuiltinAuth) Verify(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	verifId := vars["id"]
 
-	// try to get the verif from the id
-	verifDao := dao.NewUserSignupVerificationDao(ba.db)
-	if _, err := verifDao.GetById(verifId); err != nil {
+	// try to get the verif from the id, and remove it to validate the user
+	expired := false
+	userId := ""
+	err := ba.repos.WithTx(func(tx dao.Repositories) error {
+		usv, err := tx.SignupVerifications.GetById(verifId)
+		if err != nil {
+			return err
+		}
+		userId = usv.UserId
+		// the janitor will remove the user with it, or keep him unverified
+		// until he change his email again if it is an email change
+		if usv.IsExpired(time.Now()) {
+			expired = true
+			return nil
+		}
+		return tx.SignupVerifications.Delete(verifId)
+	})
+	if errors.Is(err, dao.ErrNotFound) {
 		utils.WriteJsonResponse(w, http.StatusBadRequest,
 			jsend.FailWithName("Invalid user signup verification id", "id"))
 		return
+	} else if err != nil {
+		log.Errorf("[builtinauth.Verify] unable to verify user: %s", err.Error())
+		utils.WriteError(w, err)
+		return
 	}
-
-	// remove it to validate the user
-	if err := verifDao.Delete(verifId); err != nil {
-		utils.WriteJsonResponse(w, http.StatusInternalServerError,
-			jsend.Error("database error"))
+	if expired {
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("Expired user signup verification", "id"))
 		return
 	}
+	// his tokens are cached as not verified
+	ba.cache.InvalidateUser(userId)
 
+	metrics.Verifications.Inc()
 	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(nil))
 }
 
-func (ba *BuiltinAuth) TokenInfos(
-	ctx context.Context,
-	w http.ResponseWriter,
-	r *http.Request) {
+func (ba *BuiltinAuth) TokenInfos(w http.ResponseWriter, r *http.Request) {
 	infos := map[string]interface{}{}
-	accessToken, _ := ctxext.ExtractAccessToken(ctx)
-	user, _ := ctxext.ExtractUser(ctx)
+	accessToken, ok := ctxext.ExtractAccessToken(r.Context())
+	user, ok2 := ctxext.ExtractUser(r.Context())
+	if !ok || !ok2 {
+		log.Errorf("[builtinauth.TokenInfos] no access token or user in context")
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
 	infos["access_token"] = accessToken
 	infos["user"] = user
+	w.Header().Set("ETag", utils.ETag(user.Version))
 	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(infos))
 }
@@ -0,0 +1,311 @@
+package builtinauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/middleware"
+	"github.com/jeremyletang/babakoto_api/services/user"
+	"github.com/jeremyletang/babakoto_api/session"
+)
+
+var testTokens = auth.TokenConfig{AccessTokenTtl: 3600, SignupVerificationTtl: 3600}
+
+func newTestBuiltinAuth(limit auth.LoginLimit) (BuiltinAuth, dao.Repositories) {
+	repos := memory.NewRepositories()
+	return NewBuiltinAuth(repos, NewProvider(repos), nil, session.Config{}, testTokens, limit), repos
+}
+
+// same middlewares as the routes of main
+func authenticated(repos dao.Repositories, f http.HandlerFunc) http.Handler {
+	return middleware.Chain(f,
+		middleware.Authenticate(false, session.Config{}),
+		middleware.LoadUser(repos, nil))
+}
+
+func verified(repos dao.Repositories, f http.HandlerFunc) http.Handler {
+	return middleware.Chain(f,
+		middleware.Authenticate(false, session.Config{}),
+		middleware.LoadUser(repos, nil),
+		middleware.RequireVerified(repos, nil))
+}
+
+func newRequest(method, path, body, token string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// serve return the response of h and its decoded jsend body
+func serve(h http.Handler, r *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func data(body map[string]interface{}) map[string]interface{} {
+	d, _ := body["data"].(map[string]interface{})
+	return d
+}
+
+// signup create a user and return his id and the id of his verification
+func signup(t *testing.T, ba BuiltinAuth, email, username, password string) (string, string) {
+	w, body := serve(http.HandlerFunc(ba.Signup), newRequest("POST", "/api/v1/user/signup",
+		`{"email":"`+email+`","username":"`+username+`","password":"`+password+`"}`, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("signup: expected 200, got %d: %v", w.Code, body)
+	}
+	u := data(body)["user"].(map[string]interface{})
+	usv := data(body)["signup_verification"].(map[string]interface{})
+	return u["id"].(string), usv["id"].(string)
+}
+
+func verify(ba BuiltinAuth, id string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := mux.SetURLVars(newRequest("GET", "/api/v1/user/verify/"+id, "", ""), map[string]string{"id": id})
+	return serve(http.HandlerFunc(ba.Verify), r)
+}
+
+func login(ba BuiltinAuth, identifier, password string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return serve(http.HandlerFunc(ba.Login), newRequest("POST", "/api/v1/user/login",
+		`{"identifier":"`+identifier+`","password":"`+password+`"}`, ""))
+}
+
+// loginToken log the user in and return his new access token
+func loginToken(t *testing.T, ba BuiltinAuth, identifier, password string) string {
+	w, body := login(ba, identifier, password)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d: %v", w.Code, body)
+	}
+	return data(body)["access_token"].(map[string]interface{})["id"].(string)
+}
+
+func TestSignup(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+
+	u, err := repos.Users.GetById(userId)
+	if err != nil {
+		t.Fatalf("user not created: %s", err)
+	}
+	if u.Password == "" || u.Password == "secret" || u.Version != 1 {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	usv, err := repos.SignupVerifications.GetByUserId(userId)
+	if err != nil || usv.Id != verifId {
+		t.Fatalf("expected verification %s: %v %v", verifId, usv, err)
+	}
+	if verified, _ := user.IsVerified(repos, userId); verified {
+		t.Fatalf("a new user must not be verified")
+	}
+
+	// both the email and the username are used
+	w, body := serve(http.HandlerFunc(ba.Signup), newRequest("POST", "/api/v1/user/signup",
+		`{"email":"alice@example.com","username":"alice","password":"other"}`, ""))
+	if w.Code != http.StatusBadRequest || data(body)["email"] == nil || data(body)["username"] == nil {
+		t.Fatalf("expected 400 on email and username, got %d: %v", w.Code, body)
+	}
+
+	w, body = serve(http.HandlerFunc(ba.Signup), newRequest("POST", "/api/v1/user/signup",
+		`{"email":"bob@example.com"}`, ""))
+	if w.Code != http.StatusBadRequest || data(body)["username"] == nil || data(body)["password"] == nil {
+		t.Fatalf("expected 400 on the missing fields, got %d: %v", w.Code, body)
+	}
+
+	w, _ = serve(http.HandlerFunc(ba.Signup), newRequest("POST", "/api/v1/user/signup", `{`, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 on invalid json, got %d", w.Code)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+
+	if w, body := verify(ba, verifId); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+	if verified, err := user.IsVerified(repos, userId); !verified || err != nil {
+		t.Fatalf("expected user to be verified: %v", err)
+	}
+
+	// already used
+	w, body := verify(ba, verifId)
+	if w.Code != http.StatusBadRequest || data(body)["id"] != "Invalid user signup verification id" {
+		t.Fatalf("expected 400 on the id, got %d: %v", w.Code, body)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	repos.SignupVerifications.Delete(verifId)
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification(verifId, userId, 60,
+		time.Now().Add(-time.Hour)))
+
+	w, body := verify(ba, verifId)
+	if w.Code != http.StatusBadRequest || data(body)["id"] != "Expired user signup verification" {
+		t.Fatalf("expected 400 on the id, got %d: %v", w.Code, body)
+	}
+	// left for the janitor
+	if verified, _ := user.IsVerified(repos, userId); verified {
+		t.Fatalf("the user must stay unverified")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, _ := signup(t, ba, "alice@example.com", "alice", "secret")
+
+	for _, identifier := range []string{"alice", "alice@example.com"} {
+		w, body := login(ba, identifier, "secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("login with %s: expected 200, got %d: %v", identifier, w.Code, body)
+		}
+		u := data(body)["user"].(map[string]interface{})
+		if u["id"] != userId || (u["password"] != nil && u["password"] != "") {
+			t.Fatalf("login with %s: unexpected user %v", identifier, u)
+		}
+		tokenId := data(body)["access_token"].(map[string]interface{})["id"].(string)
+		if at, err := repos.AccessTokens.GetById(tokenId); err != nil || at.UserId != userId {
+			t.Fatalf("login with %s: token not saved: %v %v", identifier, at, err)
+		}
+	}
+
+	for _, c := range []struct{ identifier, password string }{
+		{"alice", "wrong"},
+		{"bob", "secret"},
+	} {
+		w, body := login(ba, c.identifier, c.password)
+		if w.Code != http.StatusBadRequest || data(body)["login"] != "unable to login" {
+			t.Fatalf("login %s/%s: expected 400, got %d: %v", c.identifier, c.password, w.Code, body)
+		}
+	}
+
+	w, body := login(ba, "", "")
+	if w.Code != http.StatusBadRequest || data(body)["identifier"] == nil || data(body)["password"] == nil {
+		t.Fatalf("expected 400 on the missing fields, got %d: %v", w.Code, body)
+	}
+}
+
+func TestLoginLimit(t *testing.T) {
+	ba, _ := newTestBuiltinAuth(auth.LoginLimit{MaxAttempts: 2, Window: 60})
+	signup(t, ba, "alice@example.com", "alice", "secret")
+
+	login(ba, "alice", "wrong")
+	if w, body := login(ba, "alice", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+	w, body := login(ba, "alice", "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429, got %d: %v", w.Code, body)
+	}
+	// counted by identifier
+	if w, body := login(ba, "alice@example.com", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	_, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	token := loginToken(t, ba, "alice", "secret")
+	logout := verified(repos, ba.Logout)
+
+	// the account must be verified
+	if w, body := serve(logout, newRequest("POST", "/api/v1/user/logout", "", token)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %v", w.Code, body)
+	}
+	verify(ba, verifId)
+	other := loginToken(t, ba, "alice", "secret")
+
+	if w, body := serve(logout, newRequest("POST", "/api/v1/user/logout", "", token)); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", w.Code, body)
+	}
+	if _, err := repos.AccessTokens.GetById(token); err == nil {
+		t.Fatalf("expected the token to be deleted")
+	}
+	if w, body := serve(logout, newRequest("POST", "/api/v1/user/logout", "", token)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a revoked token, got %d: %v", w.Code, body)
+	}
+	// the other sessions stay open
+	if _, err := repos.AccessTokens.GetById(other); err != nil {
+		t.Fatalf("expected the other token to be kept: %s", err)
+	}
+}
+
+func TestLogoutGet(t *testing.T) {
+	sessions := session.Config{Enabled: true}
+	repos := memory.NewRepositories()
+	ba := NewBuiltinAuth(repos, NewProvider(repos), nil, sessions, testTokens, auth.LoginLimit{})
+	signup(t, ba, "alice@example.com", "alice", "secret")
+	logout := middleware.Chain(http.HandlerFunc(ba.Logout),
+		middleware.Authenticate(true, sessions),
+		middleware.LoadUser(repos, nil))
+
+	// the clients sending their token can still use GET
+	token := loginToken(t, ba, "alice", "secret")
+	if w, body := serve(logout, newRequest("GET", "/api/v1/user/logout", "", token)); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the header, got %d: %v", w.Code, body)
+	}
+	token = loginToken(t, ba, "alice", "secret")
+	if w, body := serve(logout, newRequest("GET", "/api/v1/user/logout?access_token="+token, "", "")); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the query, got %d: %v", w.Code, body)
+	}
+
+	// but not a browser sending the session cookie, a cross site link would do it
+	w, body := serve(http.HandlerFunc(ba.Login), newRequest("POST", "/api/v1/user/login",
+		`{"identifier":"alice","password":"secret","session":true}`, ""))
+	if w.Code != http.StatusOK || data(body)["csrf_token"] == nil {
+		t.Fatalf("expected 200 with a csrf token, got %d: %v", w.Code, body)
+	}
+	if data(body)["access_token"] != nil {
+		t.Fatalf("the access token must stay in the cookie, got %v", body)
+	}
+	withCookies := func(r *http.Request) *http.Request {
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+	if w, body := serve(logout, withCookies(newRequest("GET", "/api/v1/user/logout", "", ""))); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 with the cookie, got %d: %v", w.Code, body)
+	}
+	r := withCookies(newRequest("POST", "/api/v1/user/logout", "", ""))
+	r.Header.Set("X-CSRF-Token", data(body)["csrf_token"].(string))
+	if w, body := serve(logout, r); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 over POST, got %d: %v", w.Code, body)
+	}
+}
+
+func TestTokenInfos(t *testing.T) {
+	ba, repos := newTestBuiltinAuth(auth.LoginLimit{})
+	userId, verifId := signup(t, ba, "alice@example.com", "alice", "secret")
+	verify(ba, verifId)
+	token := loginToken(t, ba, "alice", "secret")
+
+	w, body := serve(verified(repos, ba.TokenInfos), newRequest("GET", "/api/v1/user/token-infos", "", token))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("expected 200 with an etag, got %d %q: %v", w.Code, w.Header().Get("ETag"), body)
+	}
+	if data(body)["user"].(map[string]interface{})["id"] != userId {
+		t.Fatalf("unexpected user %v", data(body)["user"])
+	}
+
+	if w, _ := serve(verified(repos, ba.TokenInfos), newRequest("GET", "/api/v1/user/token-infos", "", "")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package builtinauth
+
+import (
+	"errors"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Provider authenticate the users with the password saved at signup
+type Provider struct {
+	repos dao.Repositories
+}
+
+func NewProvider(repos dao.Repositories) Provider {
+	return Provider{repos: repos}
+}
+
+func (p Provider) Name() string {
+	return "builtin"
+}
+
+func (p Provider) Authenticate(c auth.Credentials) (domain.User, error) {
+	userDao := p.repos.Users
+	u, err := userDao.GetByEmailOrUsername(c.Identifier)
+	if errors.Is(err, dao.ErrNotFound) {
+		log.Errorf("[builtinauth.Provider.Authenticate] unknow identifier: %s", c.Identifier)
+		return u, auth.ErrUnknownIdentifier
+	} else if err != nil {
+		log.Errorf("[builtinauth.Provider.Authenticate] unable to get user: %s", err.Error())
+		return u, err
+	}
+
+	// try to match the password
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(c.Password)); err != nil {
+		log.Errorf("[builtinauth.Provider.Authenticate] invalid password for identifier: %s", c.Identifier)
+		return domain.User{}, auth.ErrInvalidCredentials
+	}
+
+	return u, nil
+}
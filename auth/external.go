@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/utils/errmsg"
+	"github.com/satori/go.uuid"
+)
+
+var ErrEmailAlreadyUsed = errors.New(errmsg.MailAlreadyUsed)
+
+// ErrAccountDeleted is returned when the upstream identity is linked to a
+// deleted user, he must be restored by an admin
+var ErrAccountDeleted = errors.New("This account was deleted")
+
+// ExternalUser is a user authenticated by an upstream identity provider
+// (openid connect, ldap directory ...)
+type ExternalUser struct {
+	// Issuer and Subject identify the user on the upstream provider
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// LinkExternalUser return the user linked to the upstream identity. On the first
+// login the identity is linked to the user with the same email if the provider
+// verified it, or a new user is created.
+func LinkExternalUser(repos dao.Repositories, eu ExternalUser, tokens TokenConfig) (domain.User, error) {
+	// the user, its verification and the identity are created together
+	var u domain.User
+	err := repos.WithTx(func(tx dao.Repositories) error {
+		var err error
+		u, err = linkExternalUser(tx, eu, tokens)
+		return err
+	})
+	return u, err
+}
+
+func linkExternalUser(repos dao.Repositories, eu ExternalUser, tokens TokenConfig) (domain.User, error) {
+	identityDao := repos.ExternalIdentities
+	userDao := repos.Users
+
+	// already linked
+	if ei, err := identityDao.GetByIssuerAndSubject(eu.Issuer, eu.Subject); err == nil {
+		u, err := userDao.GetById(ei.UserId)
+		if errors.Is(err, dao.ErrNotFound) {
+			log.Errorf("[auth.linkExternalUser] user [id=%s] linked to %s/%s is deleted",
+				ei.UserId, eu.Issuer, eu.Subject)
+			return u, ErrAccountDeleted
+		} else if err != nil {
+			log.Errorf("[auth.linkExternalUser] unable to get user [id=%s] linked to %s/%s: %s",
+				ei.UserId, eu.Issuer, eu.Subject, err.Error())
+		}
+		return u, err
+	} else if !errors.Is(err, dao.ErrNotFound) {
+		log.Errorf("[auth.linkExternalUser] unable to get external identity: %s", err.Error())
+		return domain.User{}, err
+	}
+
+	// an empty email would match any user without one
+	u, err := domain.User{}, dao.ErrNotFound
+	if eu.Email != "" {
+		u, err = userDao.GetByMail(eu.Email)
+	}
+
+	switch {
+	case err == nil && eu.EmailVerified:
+		// the provider verified the email, link to the existing user
+		// and consider the local account as verified as well
+		log.Infof("[auth.linkExternalUser] link %s/%s to user [id=%s]", eu.Issuer, eu.Subject, u.Id)
+		signupDao := repos.SignupVerifications
+		if usv, err := signupDao.GetByUserId(u.Id); err == nil {
+			if err := signupDao.Delete(usv.Id); err != nil {
+				log.Errorf("[auth.linkExternalUser] unable to delete signup verification: %s", err.Error())
+				return u, err
+			}
+		}
+	case err == nil:
+		// we cannot trust this email, do not link to an account we don't own
+		log.Errorf("[auth.linkExternalUser] unverified email %s already used by user [id=%s]", eu.Email, u.Id)
+		return u, ErrEmailAlreadyUsed
+	case errors.Is(err, dao.ErrNotFound):
+		// the email of a deleted user is reserved until purge
+		if eu.Email != "" {
+			if used, err := userDao.IsEmailUsed(eu.Email); err != nil {
+				log.Errorf("[auth.linkExternalUser] unable to check email: %s", err.Error())
+				return u, err
+			} else if used {
+				log.Errorf("[auth.linkExternalUser] email %s used by a deleted user", eu.Email)
+				return u, ErrEmailAlreadyUsed
+			}
+		}
+		if u, err = provision(repos, eu, tokens); err != nil {
+			return u, err
+		}
+	default:
+		log.Errorf("[auth.linkExternalUser] unable to get user by email: %s", err.Error())
+		return u, err
+	}
+
+	ei := domain.ExternalIdentity{
+		Id:        uuid.NewV4().String(),
+		UserId:    u.Id,
+		Issuer:    eu.Issuer,
+		Subject:   eu.Subject,
+		Email:     eu.Email,
+		CreatedAt: time.Now(),
+	}
+	if err := identityDao.Create(ei); err != nil {
+		log.Errorf("[auth.linkExternalUser] unable to create external identity: %s", err.Error())
+		return u, err
+	}
+
+	return u, nil
+}
+
+func provision(repos dao.Repositories, eu ExternalUser, tokens TokenConfig) (domain.User, error) {
+	userDao := repos.Users
+
+	username := eu.Username
+	if username == "" {
+		username = strings.Split(eu.Email, "@")[0]
+	}
+	if username == "" {
+		username = "user"
+	}
+
+	newUser := domain.User{
+		Id:        uuid.NewV4().String(),
+		Username:  username,
+		Email:     eu.Email,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Version:   1,
+	}
+	// the username is not owned by the upstream provider, if someone already
+	// use it make it unique using the user id
+	if used, err := userDao.IsUsernameUsed(username); err != nil {
+		log.Errorf("[auth.provision] unable to check username: %s", err.Error())
+		return newUser, err
+	} else if used {
+		newUser.Username = fmt.Sprintf("%s-%s", username, newUser.Id[:8])
+	}
+
+	// the user has no password and cannot login with the builtin auth
+	if err := userDao.Create(newUser); err != nil {
+		log.Errorf("[auth.provision] unable to create a new user: %s", err.Error())
+		return newUser, err
+	}
+
+	// same as a builtin signup, the user need to verify his email
+	if !eu.EmailVerified {
+		signupDao := repos.SignupVerifications
+		userSignupVerif := domain.NewUserSignupVerification(uuid.NewV4().String(), newUser.Id,
+			tokens.SignupVerificationTtl, time.Now())
+		if err := signupDao.Create(userSignupVerif); err != nil {
+			log.Errorf("[auth.provision] unable to create user verification: %s", err.Error())
+			return newUser, err
+		}
+	}
+
+	metrics.Signups.WithLabelValues("external").Inc()
+	log.Infof("[auth.provision] new user [id=%s] provisioned", newUser.Id)
+	return newUser, nil
+}
@@ -0,0 +1,151 @@
+package ldapauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+const (
+	defaultUserFilter        = "(uid=%s)"
+	defaultUsernameAttribute = "uid"
+	defaultEmailAttribute    = "mail"
+	dialTimeout              = 10 * time.Second
+)
+
+type Config struct {
+	// ldap://host:389 or ldaps://host:636
+	Url                string `json:"url"`
+	StartTls           bool   `json:"start_tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// service account used to search the user, anonymous search if empty
+	BindDn       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	BaseDn       string `json:"base_dn"`
+	// every %s is replaced by the escaped identifier, e.g (|(uid=%s)(mail=%s))
+	UserFilter        string `json:"user_filter"`
+	UsernameAttribute string `json:"username_attribute"`
+	EmailAttribute    string `json:"email_attribute"`
+	// the directory emails are verified, existing users with the same email
+	// are linked to the directory account
+	TrustEmail bool `json:"trust_email"`
+}
+
+// Provider authenticate the users with a bind on a ldap directory, on success
+// the directory entry is linked to a local user
+type Provider struct {
+	repos  dao.Repositories
+	config Config
+	tokens auth.TokenConfig
+}
+
+func NewProvider(repos dao.Repositories, config Config, tokens auth.TokenConfig) (Provider, error) {
+	if config.Url == "" {
+		return Provider{}, errors.New("missing ldap url")
+	}
+	if config.BaseDn == "" {
+		return Provider{}, errors.New("missing ldap base_dn")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = defaultUserFilter
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = defaultUsernameAttribute
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = defaultEmailAttribute
+	}
+	return Provider{repos: repos, config: config, tokens: tokens}, nil
+}
+
+func (p Provider) Name() string {
+	return "ldap"
+}
+
+func (p Provider) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(p.config.Url,
+		ldap.DialWithTLSConfig(tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: dialTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	if p.config.StartTls {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p Provider) Authenticate(c auth.Credentials) (domain.User, error) {
+	// an empty password is an unauthenticated bind which always succeed
+	if c.Password == "" {
+		return domain.User{}, auth.ErrInvalidCredentials
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		log.Errorf("[ldapauth.Provider.Authenticate] unable to connect to %s: %s", p.config.Url, err.Error())
+		return domain.User{}, err
+	}
+	defer conn.Close()
+
+	if p.config.BindDn != "" {
+		if err := conn.Bind(p.config.BindDn, p.config.BindPassword); err != nil {
+			log.Errorf("[ldapauth.Provider.Authenticate] unable to bind service account: %s", err.Error())
+			return domain.User{}, err
+		}
+	}
+
+	// find the user entry
+	escaped := ldap.EscapeFilter(c.Identifier)
+	filter := strings.Replace(p.config.UserFilter, "%s", escaped, -1)
+	req := ldap.NewSearchRequest(
+		p.config.BaseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(dialTimeout.Seconds()), false,
+		filter,
+		[]string{"dn", p.config.UsernameAttribute, p.config.EmailAttribute},
+		nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		log.Errorf("[ldapauth.Provider.Authenticate] unable to search user: %s", err.Error())
+		return domain.User{}, err
+	}
+	switch {
+	case res == nil || len(res.Entries) == 0:
+		log.Errorf("[ldapauth.Provider.Authenticate] unknow identifier: %s", c.Identifier)
+		return domain.User{}, auth.ErrUnknownIdentifier
+	case len(res.Entries) > 1:
+		log.Errorf("[ldapauth.Provider.Authenticate] ambiguous identifier: %s", c.Identifier)
+		return domain.User{}, auth.ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	// then check the password with a bind as the user
+	if err := conn.Bind(entry.DN, c.Password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			log.Errorf("[ldapauth.Provider.Authenticate] invalid password for identifier: %s", c.Identifier)
+			return domain.User{}, auth.ErrInvalidCredentials
+		}
+		log.Errorf("[ldapauth.Provider.Authenticate] unable to bind user: %s", err.Error())
+		return domain.User{}, err
+	}
+
+	return auth.LinkExternalUser(p.repos, auth.ExternalUser{
+		Issuer:        p.config.Url,
+		Subject:       entry.DN,
+		Email:         entry.GetAttributeValue(p.config.EmailAttribute),
+		EmailVerified: p.config.TrustEmail,
+		Username:      entry.GetAttributeValue(p.config.UsernameAttribute),
+	}, p.tokens)
+}
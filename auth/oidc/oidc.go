@@ -0,0 +1,322 @@
+package oidcauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/services/audit"
+	"github.com/jeremyletang/babakoto_api/session"
+	"github.com/jeremyletang/babakoto_api/utils"
+	"github.com/jeremyletang/babakoto_api/utils/errmsg"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// the user have ten minutes to login on the upstream provider
+	stateCookieTtl  = 600
+	stateCookieName = "oidc_state"
+)
+
+// ProviderConfig describe an upstream OpenID Connect provider,
+// the endpoints are discovered from the issuer
+type ProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectUrl  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+type provider struct {
+	config   ProviderConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// claims we care about in the id token
+type claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+type OidcAuth struct {
+	repos     dao.Repositories
+	client    *http.Client
+	sessions  session.Config
+	tokens    auth.TokenConfig
+	providers map[string]*provider
+}
+
+func NewOidcAuth(
+	repos dao.Repositories,
+	configs []ProviderConfig,
+	sessions session.Config,
+	tokens auth.TokenConfig,
+) (OidcAuth, error) {
+	return NewOidcAuthWithClient(repos, configs, sessions, tokens, http.DefaultClient)
+}
+
+// NewOidcAuthWithClient is the same as NewOidcAuth but use client for all the
+// requests made to the upstream providers (discovery, keys and code exchange)
+func NewOidcAuthWithClient(
+	repos dao.Repositories,
+	configs []ProviderConfig,
+	sessions session.Config,
+	tokens auth.TokenConfig,
+	client *http.Client,
+) (OidcAuth, error) {
+	oa := OidcAuth{
+		repos:     repos,
+		client:    client,
+		sessions:  sessions,
+		tokens:    tokens,
+		providers: map[string]*provider{},
+	}
+	ctx := oidc.ClientContext(context.Background(), client)
+
+	for _, c := range configs {
+		if c.Name == "" {
+			return oa, fmt.Errorf("missing name for oidc provider %s", c.Issuer)
+		}
+		if _, ok := oa.providers[c.Name]; ok {
+			return oa, fmt.Errorf("duplicate oidc provider %s", c.Name)
+		}
+
+		p, err := oidc.NewProvider(ctx, c.Issuer)
+		if err != nil {
+			return oa, fmt.Errorf("unable to discover oidc provider %s: %s", c.Name, err.Error())
+		}
+
+		scopes := c.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"profile", "email"}
+		}
+
+		oa.providers[c.Name] = &provider{
+			config: c,
+			oauth2: oauth2.Config{
+				ClientID:     c.ClientId,
+				ClientSecret: c.ClientSecret,
+				RedirectURL:  c.RedirectUrl,
+				Endpoint:     p.Endpoint(),
+				Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+			},
+			verifier: p.Verifier(&oidc.Config{ClientID: c.ClientId}),
+		}
+		log.Infof("[oidcauth.NewOidcAuth] oidc provider %s registered (issuer=%s)", c.Name, c.Issuer)
+	}
+
+	return oa, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (oa *OidcAuth) getProvider(w http.ResponseWriter, r *http.Request) (*provider, bool) {
+	name := mux.Vars(r)["provider"]
+	p, ok := oa.providers[name]
+	if !ok {
+		utils.WriteJsonResponse(w, http.StatusNotFound,
+			jsend.FailWithName("Unknown provider", "provider"))
+	}
+	return p, ok
+}
+
+// Login redirect the user agent to the authorization endpoint of the provider
+func (oa *OidcAuth) Login(w http.ResponseWriter, r *http.Request) {
+	p, ok := oa.getProvider(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		log.Errorf("[oidcauth.Login] unable to generate state: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		log.Errorf("[oidcauth.Login] unable to generate nonce: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+		return
+	}
+
+	// state and nonce are kept client side, the callback check that the
+	// state sent back by the provider match the one in the cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    state + "." + nonce,
+		Path:     "/",
+		MaxAge:   stateCookieTtl,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.config.RedirectUrl, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+func readStateCookie(r *http.Request) (string, string, bool) {
+	c, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Callback is called by the provider with the authorization code, exchange it
+// then login the user linked to the upstream identity
+func (oa *OidcAuth) Callback(w http.ResponseWriter, r *http.Request) {
+	p, ok := oa.getProvider(w, r)
+	if !ok {
+		return
+	}
+
+	// clear the state cookie whatever happen next
+	http.SetCookie(w, &http.Cookie{Name: stateCookieName, Path: "/", MaxAge: -1})
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Errorf("[oidcauth.Callback] provider %s returned an error: %s (%s)",
+			p.config.Name, e, query.Get("error_description"))
+		metrics.LoginFailed(metrics.ReasonUpstreamError)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("unable to login", "login"))
+		return
+	}
+
+	state, nonce, ok := readStateCookie(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		log.Errorf("[oidcauth.Callback] invalid state for provider %s", p.config.Name)
+		metrics.LoginFailed(metrics.ReasonInvalidRequest)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("Invalid state", "state"))
+		return
+	}
+
+	ctx := oidc.ClientContext(r.Context(), oa.client)
+	oauth2Token, err := p.oauth2.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		log.Errorf("[oidcauth.Callback] unable to exchange code with provider %s: %s",
+			p.config.Name, err.Error())
+		metrics.LoginFailed(metrics.ReasonUpstreamError)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("unable to login", "login"))
+		return
+	}
+
+	rawIdToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		log.Errorf("[oidcauth.Callback] missing id_token from provider %s", p.config.Name)
+		metrics.LoginFailed(metrics.ReasonUpstreamError)
+		utils.WriteJsonResponse(w, http.StatusBadGateway,
+			jsend.Error("invalid response from provider"))
+		return
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		log.Errorf("[oidcauth.Callback] invalid id_token from provider %s: %s",
+			p.config.Name, err.Error())
+		metrics.LoginFailed(metrics.ReasonInvalidCredentials)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("unable to login", "login"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		log.Errorf("[oidcauth.Callback] invalid nonce for provider %s", p.config.Name)
+		metrics.LoginFailed(metrics.ReasonInvalidRequest)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("unable to login", "login"))
+		return
+	}
+
+	var c claims
+	if err := idToken.Claims(&c); err != nil {
+		log.Errorf("[oidcauth.Callback] invalid claims from provider %s: %s",
+			p.config.Name, err.Error())
+		metrics.LoginFailed(metrics.ReasonUpstreamError)
+		utils.WriteJsonResponse(w, http.StatusBadGateway,
+			jsend.Error("invalid response from provider"))
+		return
+	}
+
+	u, err := auth.LinkExternalUser(oa.repos, auth.ExternalUser{
+		Issuer:        idToken.Issuer,
+		Subject:       c.Subject,
+		Email:         c.Email,
+		EmailVerified: c.EmailVerified,
+		Username:      c.PreferredUsername,
+	}, oa.tokens)
+	if err == auth.ErrEmailAlreadyUsed {
+		metrics.LoginFailed(metrics.ReasonEmailAlreadyUsed)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName(errmsg.MailAlreadyUsed, "email"))
+		return
+	} else if err == auth.ErrAccountDeleted {
+		metrics.LoginFailed(metrics.ReasonAccountDeleted)
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("unable to login", "login"))
+		return
+	} else if err != nil {
+		metrics.LoginFailed(metrics.ReasonInternalError)
+		utils.WriteError(w, err)
+		return
+	}
+
+	at, err := auth.GenerateAccessToken(oa.repos, u, oa.tokens.AccessTokenTtl)
+	if err != nil {
+		metrics.LoginFailed(metrics.ReasonInternalError)
+		utils.WriteError(w, err)
+		return
+	}
+
+	res := map[string]interface{}{}
+	res["user"] = u
+
+	// the callback is always reached by a browser, open a session if we can
+	if oa.sessions.Enabled {
+		csrfToken, err := session.SetCookies(w, oa.sessions, at)
+		if err != nil {
+			log.Errorf("[oidcauth.Callback] unable to create session: %s", err.Error())
+			metrics.LoginFailed(metrics.ReasonInternalError)
+			utils.WriteJsonResponse(w, http.StatusInternalServerError,
+				jsend.Error("internal error"))
+			return
+		}
+		// the token stay in the HttpOnly cookie, out of reach of the scripts
+		res["csrf_token"] = csrfToken
+	} else {
+		res["access_token"] = at
+	}
+
+	metrics.LoginSucceeded()
+	audit.Record(r.Context(), oa.repos, domain.AuditLogin, u.Id, u.Id)
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(res))
+}
@@ -0,0 +1,381 @@
+package oidcauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/session"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const clientId = "babakoto"
+
+// idp is a local stand-in for an upstream provider, it serve the discovery,
+// the keys and the token endpoint and sign the id tokens with key
+type idp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// sign the id tokens with another key than the published one
+	signer *rsa.PrivateKey
+	// claims of the next id token, iss, aud and the times are added
+	claims map[string]interface{}
+	// number of codes exchanged
+	exchanges int
+}
+
+func newIdp(t *testing.T) *idp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &idp{key: key, signer: key}
+	routes := http.NewServeMux()
+	routes.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	routes.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &p.key.PublicKey,
+			KeyID:     "test",
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	})
+	routes.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.exchanges++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "upstream-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(t),
+		})
+	})
+	p.server = httptest.NewServer(routes)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *idp) idToken(t *testing.T) string {
+	claims := map[string]interface{}{
+		"iss": p.server.URL,
+		"aud": clientId,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.signer},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func newTestOidcAuth(t *testing.T, p *idp) (OidcAuth, dao.Repositories) {
+	repos := memory.NewRepositories()
+	oa, err := NewOidcAuthWithClient(repos, []ProviderConfig{{
+		Name:        "test",
+		Issuer:      p.server.URL,
+		ClientId:    clientId,
+		RedirectUrl: "http://localhost/api/v1/user/oidc/test/callback",
+	}}, session.Config{}, auth.TokenConfig{AccessTokenTtl: 3600, SignupVerificationTtl: 3600},
+		p.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oa, repos
+}
+
+func withProvider(r *http.Request) *http.Request {
+	return mux.SetURLVars(r, map[string]string{"provider": "test"})
+}
+
+// login start the flow and return the state cookie with its state and nonce
+func login(t *testing.T, oa OidcAuth) (*http.Cookie, string, string) {
+	w := httptest.NewRecorder()
+	oa.Login(w, withProvider(httptest.NewRequest("GET", "/api/v1/user/oidc/test/login", nil)))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: expected 302, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookieName {
+		t.Fatalf("login: expected the state cookie, got %v", cookies)
+	}
+	parts := strings.SplitN(cookies[0].Value, ".", 2)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != parts[0] || location.Query().Get("nonce") != parts[1] {
+		t.Fatalf("login: state and nonce of %s do not match the cookie", location)
+	}
+	return cookies[0], parts[0], parts[1]
+}
+
+func callback(oa OidcAuth, cookie *http.Cookie, state string) (int, map[string]interface{}) {
+	r := httptest.NewRequest("GET", "/api/v1/user/oidc/test/callback?code=abc&state="+url.QueryEscape(state), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	oa.Callback(w, withProvider(r))
+	body := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestCallbackProvision(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":                "alice-sub",
+		"nonce":              nonce,
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+	}
+	code, body := callback(oa, cookie, state)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+
+	ei, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "alice-sub")
+	if err != nil {
+		t.Fatalf("identity not linked: %s", err)
+	}
+	u, err := repos.Users.GetById(ei.UserId)
+	if err != nil || u.Username != "alice" || u.Email != "alice@example.com" {
+		t.Fatalf("user not provisioned: %v %v", u, err)
+	}
+	// the provider verified the email
+	if _, err := repos.SignupVerifications.GetByUserId(u.Id); err == nil {
+		t.Fatalf("expected no signup verification")
+	}
+	if _, err := repos.AccessTokens.GetByUserId(u.Id); err != nil {
+		t.Fatalf("expected an access token: %s", err)
+	}
+
+	// the next login find the same user
+	cookie, state, nonce = login(t, oa)
+	p.claims["nonce"] = nonce
+	if code, body = callback(oa, cookie, state); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	data := body["data"].(map[string]interface{})
+	if data["user"].(map[string]interface{})["id"] != u.Id {
+		t.Fatalf("expected user %s, got %v", u.Id, data["user"])
+	}
+}
+
+func TestCallbackSession(t *testing.T) {
+	p := newIdp(t)
+	oa, _ := newTestOidcAuth(t, p)
+	oa.sessions = session.Config{Enabled: true}
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "alice-sub",
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+	code, body := callback(oa, cookie, state)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	// the access token stay in the HttpOnly cookie
+	data := body["data"].(map[string]interface{})
+	if data["csrf_token"] == nil || data["access_token"] != nil {
+		t.Fatalf("expected a csrf token without the access token, got %v", data)
+	}
+}
+
+func TestCallbackLinkVerifiedEmail(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+	u := domain.User{Id: "bob-id", Username: "bob", Email: "bob@example.com", Version: 1}
+	if err := repos.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("usv", u.Id, 3600, time.Now()))
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "bob-sub",
+		"nonce":          nonce,
+		"email":          "bob@example.com",
+		"email_verified": true,
+	}
+	if code, body := callback(oa, cookie, state); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	ei, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "bob-sub")
+	if err != nil || ei.UserId != u.Id {
+		t.Fatalf("expected identity linked to %s: %v %v", u.Id, ei, err)
+	}
+	// the local account is verified with it
+	if _, err := repos.SignupVerifications.GetByUserId(u.Id); err == nil {
+		t.Fatalf("expected the signup verification to be removed")
+	}
+}
+
+func TestCallbackUnverifiedEmail(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+	u := domain.User{Id: "bob-id", Username: "bob", Email: "bob@example.com", Version: 1}
+	if err := repos.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "mallory-sub",
+		"nonce":          nonce,
+		"email":          "bob@example.com",
+		"email_verified": false,
+	}
+	code, body := callback(oa, cookie, state)
+	if code != http.StatusBadRequest || body["status"] != "fail" {
+		t.Fatalf("expected 400 fail, got %d: %v", code, body)
+	}
+	if _, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "mallory-sub"); err == nil {
+		t.Fatalf("identity must not be linked to a user with an unverified email")
+	}
+	if _, err := repos.AccessTokens.GetByUserId(u.Id); err == nil {
+		t.Fatalf("expected no access token")
+	}
+}
+
+func TestCallbackUnverifiedEmailProvision(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "carol-sub",
+		"nonce":          nonce,
+		"email":          "carol@example.com",
+		"email_verified": false,
+	}
+	if code, body := callback(oa, cookie, state); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	ei, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "carol-sub")
+	if err != nil {
+		t.Fatalf("identity not linked: %s", err)
+	}
+	// like a builtin signup the email must be verified
+	if _, err := repos.SignupVerifications.GetByUserId(ei.UserId); err != nil {
+		t.Fatalf("expected a signup verification: %s", err)
+	}
+}
+
+func TestCallbackInvalidState(t *testing.T) {
+	p := newIdp(t)
+	oa, _ := newTestOidcAuth(t, p)
+
+	cookie, _, nonce := login(t, oa)
+	p.claims = map[string]interface{}{"sub": "alice-sub", "nonce": nonce}
+	code, body := callback(oa, cookie, "forged")
+	if code != http.StatusBadRequest || body["status"] != "fail" {
+		t.Fatalf("expected 400 fail, got %d: %v", code, body)
+	}
+	if p.exchanges != 0 {
+		t.Fatalf("the code must not be exchanged with an invalid state")
+	}
+
+	// without the cookie
+	r := httptest.NewRequest("GET", "/api/v1/user/oidc/test/callback?code=abc&state=forged", nil)
+	w := httptest.NewRecorder()
+	oa.Callback(w, withProvider(r))
+	if w.Code != http.StatusBadRequest || p.exchanges != 0 {
+		t.Fatalf("expected 400 without exchange, got %d", w.Code)
+	}
+}
+
+func TestCallbackInvalidNonce(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+
+	cookie, state, _ := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "alice-sub",
+		"nonce":          "replayed",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+	code, body := callback(oa, cookie, state)
+	if code != http.StatusBadRequest || body["status"] != "fail" {
+		t.Fatalf("expected 400 fail, got %d: %v", code, body)
+	}
+	if _, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "alice-sub"); err == nil {
+		t.Fatalf("identity must not be linked with an invalid nonce")
+	}
+}
+
+func TestCallbackInvalidIdToken(t *testing.T) {
+	p := newIdp(t)
+	oa, repos := newTestOidcAuth(t, p)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.signer = other
+
+	cookie, state, nonce := login(t, oa)
+	p.claims = map[string]interface{}{
+		"sub":            "alice-sub",
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+	code, body := callback(oa, cookie, state)
+	if code != http.StatusBadRequest || body["status"] != "fail" {
+		t.Fatalf("expected 400 fail, got %d: %v", code, body)
+	}
+	if _, err := repos.ExternalIdentities.GetByIssuerAndSubject(p.server.URL, "alice-sub"); err == nil {
+		t.Fatalf("identity must not be linked with an invalid id token")
+	}
+
+	// signed by the provider but for another client
+	p.signer = p.key
+	cookie, state, nonce = login(t, oa)
+	p.claims["nonce"] = nonce
+	p.claims["aud"] = "another-client"
+	if code, body := callback(oa, cookie, state); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %v", code, body)
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+var (
+	// ErrUnknownIdentifier is returned by a provider which don't know the
+	// identifier, the next provider of the chain is tried
+	ErrUnknownIdentifier = errors.New("unknown identifier")
+	// ErrInvalidCredentials is returned by a provider which know the
+	// identifier but the password do not match
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+type Credentials struct {
+	Identifier string
+	Password   string
+}
+
+// Provider authenticate credentials against a backend (the builtin users
+// table, a ldap directory ...) and return the local user
+type Provider interface {
+	Name() string
+	Authenticate(c Credentials) (domain.User, error)
+}
+
+// Chain try each provider in order until one authenticate the credentials
+type Chain []Provider
+
+// NewChain build a chain from the provider names in order, all the names
+// must be in available
+func NewChain(names []string, available map[string]Provider) (Chain, error) {
+	chain := Chain{}
+	for _, name := range names {
+		p, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown auth provider %s", name)
+		}
+		chain = append(chain, p)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no auth provider configured")
+	}
+	return chain, nil
+}
+
+func (c Chain) Name() string {
+	return "chain"
+}
+
+func (c Chain) Authenticate(cred Credentials) (domain.User, error) {
+	var lastErr error = ErrUnknownIdentifier
+	for _, p := range c {
+		u, err := p.Authenticate(cred)
+		switch err {
+		case nil:
+			return u, nil
+		case ErrUnknownIdentifier:
+		case ErrInvalidCredentials:
+			// the same identifier can exist in another provider
+			// (e.g a user provisioned from the directory)
+			if lastErr == ErrUnknownIdentifier {
+				lastErr = err
+			}
+		case ErrEmailAlreadyUsed:
+			lastErr = err
+		case ErrAccountDeleted:
+			// the user is known but must be restored first, another
+			// provider must not log him in
+			return domain.User{}, err
+		default:
+			// a backend is down, other providers can still login the user
+			log.Errorf("[auth.Chain.Authenticate] provider %s failed: %s", p.Name(), err.Error())
+			lastErr = err
+		}
+	}
+	return domain.User{}, lastErr
+}
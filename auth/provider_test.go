@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+// testProvider answer err, or its user if err is nil, and count its calls
+type testProvider struct {
+	name  string
+	err   error
+	calls *int
+}
+
+func (p testProvider) Name() string {
+	return p.name
+}
+
+func (p testProvider) Authenticate(c Credentials) (domain.User, error) {
+	*p.calls++
+	if p.err != nil {
+		return domain.User{}, p.err
+	}
+	return domain.User{Id: p.name}, nil
+}
+
+func TestChain(t *testing.T) {
+	errDown := errors.New("backend down")
+	for _, c := range []struct {
+		name     string
+		errs     []error
+		expected error
+		user     string
+		calls    int
+	}{
+		{"first match", []error{nil, nil}, nil, "p0", 1},
+		{"unknown then match", []error{ErrUnknownIdentifier, nil}, nil, "p1", 2},
+		{"invalid then match", []error{ErrInvalidCredentials, nil}, nil, "p1", 2},
+		{"down then match", []error{errDown, nil}, nil, "p1", 2},
+		{"unknown everywhere", []error{ErrUnknownIdentifier, ErrUnknownIdentifier}, ErrUnknownIdentifier, "", 2},
+		{"invalid before unknown", []error{ErrInvalidCredentials, ErrUnknownIdentifier}, ErrInvalidCredentials, "", 2},
+		{"invalid after unknown", []error{ErrUnknownIdentifier, ErrInvalidCredentials}, ErrInvalidCredentials, "", 2},
+		{"down over invalid", []error{ErrInvalidCredentials, errDown}, errDown, "", 2},
+		{"email used", []error{ErrEmailAlreadyUsed, ErrUnknownIdentifier}, ErrEmailAlreadyUsed, "", 2},
+		// a deleted user stop the chain
+		{"deleted", []error{ErrAccountDeleted, nil}, ErrAccountDeleted, "", 1},
+	} {
+		calls := 0
+		chain := Chain{}
+		for i, err := range c.errs {
+			chain = append(chain, testProvider{name: "p" + string(rune('0'+i)), err: err, calls: &calls})
+		}
+		u, err := chain.Authenticate(Credentials{Identifier: "alice", Password: "secret"})
+		if err != c.expected || u.Id != c.user || calls != c.calls {
+			t.Fatalf("%s: expected %v %q after %d calls, got %v %q after %d", c.name,
+				c.expected, c.user, c.calls, err, u.Id, calls)
+		}
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	calls := 0
+	available := map[string]Provider{
+		"builtin": testProvider{name: "builtin", err: ErrUnknownIdentifier, calls: &calls},
+		"ldap":    testProvider{name: "ldap", calls: &calls},
+	}
+	chain, err := NewChain([]string{"ldap", "builtin"}, available)
+	if err != nil || len(chain) != 2 || chain[0].Name() != "ldap" || chain[1].Name() != "builtin" {
+		t.Fatalf("expected the providers in order: %v %v", chain, err)
+	}
+	if _, err := NewChain([]string{"builtin", "saml"}, available); err == nil {
+		t.Fatalf("expected an unknown provider to fail")
+	}
+	if _, err := NewChain(nil, available); err == nil {
+		t.Fatalf("expected an empty chain to fail")
+	}
+}
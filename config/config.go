@@ -0,0 +1,143 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/auth/ldap"
+	"github.com/jeremyletang/babakoto_api/auth/oidc"
+	"github.com/jeremyletang/babakoto_api/dao/redis"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/janitor"
+	"github.com/jeremyletang/babakoto_api/logging"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/middleware"
+	"github.com/jeremyletang/babakoto_api/pii"
+	"github.com/jeremyletang/babakoto_api/server"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
+	"github.com/jeremyletang/babakoto_api/session"
+)
+
+// DefaultPath is used when no --config flag is given, the file is optional
+// in this case so everything can come from the environment
+const DefaultPath = ".babakoto.config.json"
+
+const (
+	defaultListen = ":9992"
+	// seconds for a day
+	defaultSignupVerificationTtl = 86400
+	// accesstoken = two days
+	defaultAccessTokenTtl = 172800
+	// ten minutes of preflight cache
+	defaultCorsMaxAge = 600
+	// fifteen minutes
+	defaultLoginLimitWindow = 900
+)
+
+// where the access tokens and the rate limit counters are kept
+const (
+	StoreDatabase = "database"
+	StoreRedis    = "redis"
+)
+
+type AuthConfig struct {
+	// providers used to login with identifier/password, tried in order
+	Providers []string                  `json:"providers"`
+	Ldap      *ldapauth.Config          `json:"ldap"`
+	Oidc      []oidcauth.ProviderConfig `json:"oidc"`
+	// accept the access_token query/form parameter (RFC 6750 section 2.2 and 2.3)
+	AllowQueryToken bool             `json:"allow_query_token"`
+	Tokens          auth.TokenConfig `json:"tokens"`
+	// cache of the access tokens used by the authenticated routes
+	Cache      authcache.Config `json:"cache"`
+	LoginLimit auth.LoginLimit  `json:"login_limit"`
+}
+
+// StoreConfig select where the access tokens and the rate limit counters are
+// kept, the database (default) or a redis server shared by the replicas. The
+// signup verifications always stay in the database: a verification which
+// expired in redis would be gone, and its user seen as verified instead of
+// being purged by the janitor.
+type StoreConfig struct {
+	Driver string       `json:"driver"`
+	Redis  redis.Config `json:"redis"`
+}
+
+type Config struct {
+	// keep the data in memory instead of the database, for local development only
+	Dev      bool                  `json:"dev"`
+	Server   server.Config         `json:"server"`
+	Cors     middleware.CorsConfig `json:"cors"`
+	Database database.Config       `json:"database"`
+	Auth     AuthConfig            `json:"auth"`
+	Session  session.Config        `json:"session"`
+	Logging  logging.Config        `json:"logging"`
+	Metrics  metrics.Config        `json:"metrics"`
+	Janitor  janitor.Config        `json:"janitor"`
+	// encryption of the personal data, in clear without keys
+	Pii   pii.Config  `json:"pii"`
+	Store StoreConfig `json:"store"`
+}
+
+// Load read the json file at path, apply the BABAKOTO_* environment
+// variables over it then fill the defaults and validate the result
+func Load(path string) (Config, error) {
+	var c Config
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return c, fmt.Errorf("invalid config format in %s: %s", path, err.Error())
+		}
+	case os.IsNotExist(err) && path == DefaultPath:
+		// only the environment is used
+	default:
+		return c, fmt.Errorf("unable to read config file: %s", err.Error())
+	}
+
+	problems := newEnv(os.Environ()).apply(reflect.ValueOf(&c).Elem(), envPrefix)
+	setDefaults(&c)
+	problems = append(problems, validate(c)...)
+	if len(problems) > 0 {
+		return c, ValidationError(problems)
+	}
+	return c, nil
+}
+
+func setDefaults(c *Config) {
+	if c.Server.Listen == "" {
+		c.Server.Listen = defaultListen
+	}
+	c.Database = c.Database.WithDefaults()
+	if len(c.Auth.Providers) == 0 {
+		c.Auth.Providers = []string{"builtin"}
+	}
+	if c.Auth.Tokens.AccessTokenTtl == 0 {
+		c.Auth.Tokens.AccessTokenTtl = defaultAccessTokenTtl
+	}
+	if c.Auth.Tokens.SignupVerificationTtl == 0 {
+		c.Auth.Tokens.SignupVerificationTtl = defaultSignupVerificationTtl
+	}
+	if c.Auth.LoginLimit.Window == 0 {
+		c.Auth.LoginLimit.Window = defaultLoginLimitWindow
+	}
+	if c.Store.Driver == "" {
+		c.Store.Driver = StoreDatabase
+	}
+	if len(c.Cors.AllowedOrigins) == 0 {
+		c.Cors.AllowedOrigins = []string{"*"}
+	}
+	if len(c.Cors.AllowedMethods) == 0 {
+		c.Cors.AllowedMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	}
+	if len(c.Cors.AllowedHeaders) == 0 {
+		c.Cors.AllowedHeaders = []string{"*"}
+	}
+	if c.Cors.MaxAge == 0 {
+		c.Cors.MaxAge = defaultCorsMaxAge
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	envPrefix = "BABAKOTO"
+	// BABAKOTO_DATABASE_PASSWORD_FILE=/run/secrets/db_password
+	fileSuffix = "_FILE"
+)
+
+// env hold the environment variables used to override the configuration
+type env map[string]string
+
+func newEnv(environ []string) env {
+	e := env{}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, envPrefix+"_") {
+			e[kv[:i]] = kv[i+1:]
+		}
+	}
+	return e
+}
+
+// lookup return the value of the variable name, or the content of the
+// file given by name_FILE for the secrets mounted by the containers
+func (e env) lookup(name string) (string, bool, error) {
+	if v, ok := e[name]; ok {
+		return v, true, nil
+	}
+	path, ok := e[name+fileSuffix]
+	if !ok {
+		return "", false, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: unable to read %s: %s", name+fileSuffix, path, err.Error())
+	}
+	return strings.TrimRight(string(raw), "\r\n"), true, nil
+}
+
+// hasPrefix tell if a variable for a field under prefix is set
+func (e env) hasPrefix(prefix string) bool {
+	for name := range e {
+		if strings.HasPrefix(name, prefix+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// apply set the fields of v using the environment, the name of a variable
+// is the prefix then the json names of the fields in upper case, e.g
+// BABAKOTO_DATABASE_PASSWORD or BABAKOTO_AUTH_OIDC_0_CLIENT_SECRET
+func (e env) apply(v reflect.Value, prefix string) []string {
+	problems := []string{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		problems = append(problems, e.applyField(v.Field(i), prefix+"_"+strings.ToUpper(name))...)
+	}
+	return problems
+}
+
+func (e env) applyField(f reflect.Value, name string) []string {
+	switch f.Kind() {
+	case reflect.Struct:
+		return e.apply(f, name)
+	case reflect.Ptr:
+		if f.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		if f.IsNil() {
+			// only create the section if something is set in it
+			if !e.hasPrefix(name) {
+				return nil
+			}
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		return e.apply(f.Elem(), name)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		// override the existing entries by index, or add new ones
+		problems := []string{}
+		for i := 0; i < f.Len() || e.hasPrefix(fmt.Sprintf("%s_%d", name, i)); i++ {
+			if i == f.Len() {
+				f.Set(reflect.Append(f, reflect.New(f.Type().Elem()).Elem()))
+			}
+			problems = append(problems, e.apply(f.Index(i), fmt.Sprintf("%s_%d", name, i))...)
+		}
+		return problems
+	}
+
+	raw, ok, err := e.lookup(name)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if !ok {
+		return nil
+	}
+	if err := setValue(f, raw); err != nil {
+		return []string{fmt.Sprintf("%s: %s", name, err.Error())}
+	}
+	return nil
+}
+
+func setValue(f reflect.Value, raw string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %s", raw)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %s", raw)
+		}
+		f.SetInt(n)
+	case reflect.Slice:
+		// comma separated list
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", f.Type())
+		}
+		values := []string{}
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		f.Set(reflect.ValueOf(values))
+	case reflect.Map:
+		// key=value,key=value
+		if f.Type().Key().Kind() != reflect.String || f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", f.Type())
+		}
+		values := map[string]string{}
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid entry %s, expected key=value", s)
+			}
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		f.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/logging"
+	"github.com/jeremyletang/babakoto_api/pii"
+)
+
+// ValidationError list all the problems found in the configuration so they
+// can be fixed at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// login providers which can be listed in auth.providers
+var knownProviders = map[string]bool{"builtin": true, "ldap": true}
+
+// Validate check a configuration with the defaults already set
+func Validate(c Config) error {
+	if problems := validate(c); len(problems) > 0 {
+		return ValidationError(problems)
+	}
+	return nil
+}
+
+func validate(c Config) []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// server
+	if _, _, err := net.SplitHostPort(c.Server.Listen); err != nil {
+		add("server.listen: invalid address %s", c.Server.Listen)
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"read_timeout", c.Server.ReadTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"max_header_bytes", c.Server.MaxHeaderBytes},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+		{"shutdown_delay", c.Server.ShutdownDelay},
+	} {
+		if f.value < 0 {
+			add("server.%s: must be positive", f.name)
+		}
+	}
+	if c.Server.Tls != nil {
+		if c.Server.Tls.CertFile == "" {
+			add("server.tls.cert_file: missing")
+		}
+		if c.Server.Tls.KeyFile == "" {
+			add("server.tls.key_file: missing")
+		}
+	}
+
+	// cors
+	for _, origin := range c.Cors.AllowedOrigins {
+		switch {
+		case origin == "*":
+			if c.Cors.AllowCredentials {
+				add("cors.allowed_origins: \"*\" cannot be used with allow_credentials")
+			}
+		case strings.Count(origin, "*") > 1:
+			add("cors.allowed_origins: %s has more than one wildcard", origin)
+		case !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://"):
+			add("cors.allowed_origins: %s must start with http:// or https://", origin)
+		}
+	}
+
+	// database, not used in dev mode
+	if !c.Dev {
+		switch c.Database.Driver {
+		case database.Mysql, database.Postgres:
+			if c.Database.User == "" {
+				add("database.user: missing")
+			}
+			if c.Database.Host == "" {
+				add("database.host: missing")
+			}
+			if _, err := strconv.ParseUint(c.Database.Port, 10, 16); err != nil {
+				add("database.port: invalid port %s", c.Database.Port)
+			}
+			if c.Database.Name == "" {
+				add("database.name: missing")
+			}
+			for i, r := range c.Database.Replicas {
+				if r.Host == "" {
+					add("database.replicas[%d].host: missing", i)
+				}
+				if r.Port == "" {
+					continue
+				}
+				if _, err := strconv.ParseUint(r.Port, 10, 16); err != nil {
+					add("database.replicas[%d].port: invalid port %s", i, r.Port)
+				}
+			}
+		case database.Sqlite3:
+			if c.Database.Path == "" {
+				add("database.path: missing")
+			}
+			if len(c.Database.Replicas) > 0 {
+				add("database.replicas: not supported with sqlite3")
+			}
+		default:
+			add("database.driver: must be mysql, postgres or sqlite3")
+		}
+		for _, f := range []struct {
+			name  string
+			value int
+		}{
+			{"max_open_conns", c.Database.MaxOpenConns},
+			{"max_idle_conns", c.Database.MaxIdleConns},
+			{"conn_max_lifetime", c.Database.ConnMaxLifetime},
+			{"conn_max_idle_time", c.Database.ConnMaxIdleTime},
+			{"startup_timeout", c.Database.StartupTimeout},
+		} {
+			if f.value < 0 {
+				add("database.%s: must be positive", f.name)
+			}
+		}
+	}
+
+	// auth
+	for _, name := range c.Auth.Providers {
+		if !knownProviders[name] {
+			add("auth.providers: unknown provider %s", name)
+		}
+		if name == "ldap" && c.Auth.Ldap == nil {
+			add("auth.providers: ldap is used but auth.ldap is missing")
+		}
+	}
+	if c.Auth.Ldap != nil {
+		if c.Auth.Ldap.Url == "" {
+			add("auth.ldap.url: missing")
+		}
+		if c.Auth.Ldap.BaseDn == "" {
+			add("auth.ldap.base_dn: missing")
+		}
+	}
+	names := map[string]bool{}
+	for i, p := range c.Auth.Oidc {
+		if p.Name == "" {
+			add("auth.oidc[%d].name: missing", i)
+		} else if names[p.Name] {
+			add("auth.oidc[%d].name: duplicate provider %s", i, p.Name)
+		}
+		names[p.Name] = true
+		if p.Issuer == "" {
+			add("auth.oidc[%d].issuer: missing", i)
+		}
+		if p.ClientId == "" {
+			add("auth.oidc[%d].client_id: missing", i)
+		}
+		if p.RedirectUrl == "" {
+			add("auth.oidc[%d].redirect_url: missing", i)
+		}
+	}
+	if c.Auth.Tokens.AccessTokenTtl <= 0 {
+		add("auth.tokens.access_token_ttl: must be positive")
+	}
+	if c.Auth.Tokens.SignupVerificationTtl <= 0 {
+		add("auth.tokens.signup_verification_ttl: must be positive")
+	}
+	if c.Auth.Cache.Size < 0 {
+		add("auth.cache.size: must be positive")
+	}
+	if c.Auth.Cache.Ttl < 0 {
+		add("auth.cache.ttl: must be positive")
+	}
+	if c.Auth.LoginLimit.MaxAttempts < 0 {
+		add("auth.login_limit.max_attempts: must be positive")
+	}
+	if c.Auth.LoginLimit.Window < 0 {
+		add("auth.login_limit.window: must be positive")
+	}
+
+	// store
+	switch c.Store.Driver {
+	case StoreDatabase:
+	case StoreRedis:
+		if c.Store.Redis.Addr == "" {
+			add("store.redis.addr: missing")
+		}
+	default:
+		add("store.driver: must be database or redis")
+	}
+
+	// session
+	switch strings.ToLower(c.Session.SameSite) {
+	case "", "lax", "strict":
+	default:
+		add("session.same_site: must be lax or strict")
+	}
+
+	// logging
+	if err := logging.Validate(c.Logging); err != nil {
+		add("logging: %s", err.Error())
+	}
+
+	// metrics
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			add("metrics.listen: invalid address %s", c.Metrics.Listen)
+		} else if c.Metrics.Listen == c.Server.Listen {
+			add("metrics.listen: must be different from server.listen")
+		}
+	}
+
+	// janitor
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"tokens_interval", c.Janitor.TokensInterval},
+		{"signups_interval", c.Janitor.SignupsInterval},
+		{"deleted_users_interval", c.Janitor.DeletedUsersInterval},
+		{"deleted_users_retention", c.Janitor.DeletedUsersRetention},
+		{"lease_ttl", c.Janitor.LeaseTtl},
+	} {
+		if f.value < 0 {
+			add("janitor.%s: must be positive", f.name)
+		}
+	}
+
+	// pii
+	if _, err := pii.Load(c.Pii); err != nil {
+		add("pii: %s", err.Error())
+	}
+
+	return problems
+}
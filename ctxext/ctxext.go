@@ -6,10 +6,15 @@ import (
 	"github.com/jeremyletang/babakoto_api/domain"
 )
 
+// unexported so the keys cannot collide with other packages
+type key string
+
 const (
-	accessTokenStringKey = "access_token"
-	accessTokenKey       = "domain.AccessToken"
-	userKey              = "domain.User"
+	accessTokenStringKey key = "access_token"
+	accessTokenKey       key = "domain.AccessToken"
+	userKey              key = "domain.User"
+	requestInfoKey       key = "request_info"
+	sessionCookieKey     key = "session_cookie"
 )
 
 func ExtractAccessTokenString(ctx context.Context) (string, bool) {
@@ -38,3 +43,38 @@ func AddUser(ctx context.Context, u domain.User) context.Context {
 func AddAccessToken(ctx context.Context, at domain.AccessToken) context.Context {
 	return context.WithValue(ctx, accessTokenKey, at)
 }
+
+// FromSessionCookie tell if the access token was read from the session
+// cookie, the browser send it by itself unlike the header or the query
+func FromSessionCookie(ctx context.Context) bool {
+	fromCookie, _ := ctx.Value(sessionCookieKey).(bool)
+	return fromCookie
+}
+
+func AddFromSessionCookie(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionCookieKey, true)
+}
+
+// RequestInfo is shared by all the handlers of a request, the inner ones
+// complete it for the outer ones (e.g the access log need the user id)
+type RequestInfo struct {
+	Id     string
+	Route  string
+	UserId string
+}
+
+func ExtractRequestInfo(ctx context.Context) (*RequestInfo, bool) {
+	ri, ok := ctx.Value(requestInfoKey).(*RequestInfo)
+	return ri, ok
+}
+
+func ExtractRequestId(ctx context.Context) (string, bool) {
+	if ri, ok := ExtractRequestInfo(ctx); ok {
+		return ri.Id, true
+	}
+	return "", false
+}
+
+func AddRequestInfo(ctx context.Context, ri *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, ri)
+}
@@ -1,34 +1,61 @@
 package dao
 
 import (
+	"time"
+
 	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
 	"github.com/jinzhu/gorm"
 )
 
 type AccessToken struct {
-	db *gorm.DB
+	db    *gorm.DB
+	route router
 }
 
 func NewAccessTokenDao(db *gorm.DB) *AccessToken {
-	return &AccessToken{db: db}
+	return &AccessToken{db: db, route: router{primary: db}}
 }
 
 func (atd *AccessToken) GetById(id string) (domain.AccessToken, error) {
-	at := domain.AccessToken{Id: id}
-	err := atd.db.First(&at).Error
-	return at, err
+	at := domain.AccessToken{}
+	err := atd.db.Where("access_tokens.id = ?", id).First(&at).Error
+	return at, wrap(err)
 }
 
 func (atd *AccessToken) GetByUserId(userId string) (domain.AccessToken, error) {
-	u := domain.AccessToken{UserId: userId}
-	err := atd.db.First(&u).Error
-	return u, err
+	at := domain.AccessToken{}
+	err := atd.db.Where("access_tokens.user_id = ?", userId).First(&at).Error
+	return at, wrap(err)
 }
 
 func (atd *AccessToken) Create(at domain.AccessToken) error {
-	return atd.db.Create(&at).Error
+	return wrap(atd.db.Create(&at).Error)
 }
 
 func (atd *AccessToken) Delete(id string) error {
-	return atd.db.Delete(&domain.AccessToken{Id: id}).Error
+	return wrap(atd.db.Where("access_tokens.id = ?", id).Delete(&domain.AccessToken{}).Error)
+}
+
+func (atd *AccessToken) DeleteByUserId(userId string) error {
+	return wrap(atd.db.Where("access_tokens.user_id = ?", userId).Delete(&domain.AccessToken{}).Error)
+}
+
+func (atd *AccessToken) DeleteExpired(now time.Time) (int64, error) {
+	res := atd.db.Where("access_tokens.expires_at < ?", now.UTC()).Delete(&domain.AccessToken{})
+	return res.RowsAffected, wrap(res.Error)
+}
+
+func (atd *AccessToken) List(page pagination.Page) ([]domain.AccessToken, string, error) {
+	ats := []domain.AccessToken{}
+	err := atd.route.read(func(db *gorm.DB) error {
+		return page.Apply(db).Find(&ats).Error
+	})
+	if err != nil {
+		return nil, "", wrap(err)
+	}
+	n, next := page.Next(len(ats), func(i int, column string) interface{} {
+		return AccessTokenColumn(ats[i], column)
+	})
+	return ats[:n], next, nil
 }
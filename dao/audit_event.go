@@ -0,0 +1,34 @@
+package dao
+
+import (
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jinzhu/gorm"
+)
+
+type AuditEvent struct {
+	db    *gorm.DB
+	route router
+}
+
+func NewAuditEventDao(db *gorm.DB) *AuditEvent {
+	return &AuditEvent{db: db, route: router{primary: db}}
+}
+
+func (aed *AuditEvent) Create(e domain.AuditEvent) error {
+	return wrap(aed.db.Create(&e).Error)
+}
+
+func (aed *AuditEvent) List(page pagination.Page) ([]domain.AuditEvent, string, error) {
+	es := []domain.AuditEvent{}
+	err := aed.route.read(func(db *gorm.DB) error {
+		return page.Apply(db).Find(&es).Error
+	})
+	if err != nil {
+		return nil, "", wrap(err)
+	}
+	n, next := page.Next(len(es), func(i int, column string) interface{} {
+		return AuditEventColumn(es[i], column)
+	})
+	return es[:n], next, nil
+}
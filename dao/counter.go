@@ -0,0 +1,74 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// counter is a row of the counters table
+type counter struct {
+	Name      string `gorm:"primary_key"`
+	Value     int64
+	ExpiresAt time.Time
+}
+
+func (counter) TableName() string {
+	return "counters"
+}
+
+// the replicas can race on the creation of a counter, the loser try again
+const counterAttempts = 3
+
+type Counter struct {
+	db *gorm.DB
+}
+
+func NewCounterDao(db *gorm.DB) *Counter {
+	return &Counter{db: db}
+}
+
+func (cd *Counter) Incr(key string, window time.Duration) (int64, error) {
+	for i := 0; i < counterAttempts; i++ {
+		now := time.Now().UTC()
+		// count in the current window
+		res := cd.db.Model(&counter{}).
+			Where("counters.name = ? AND counters.expires_at > ?", key, now).
+			UpdateColumn("value", gorm.Expr("value + 1"))
+		if res.Error != nil {
+			return 0, wrap(res.Error)
+		}
+		if res.RowsAffected > 0 {
+			c := counter{}
+			if err := cd.db.Where("counters.name = ?", key).First(&c).Error; err != nil {
+				return 0, wrap(err)
+			}
+			return c.Value, nil
+		}
+
+		// or start a new one
+		res = cd.db.Model(&counter{}).
+			Where("counters.name = ? AND counters.expires_at <= ?", key, now).
+			UpdateColumns(map[string]interface{}{"value": 1, "expires_at": now.Add(window)})
+		if res.Error != nil {
+			return 0, wrap(res.Error)
+		}
+		if res.RowsAffected > 0 {
+			return 1, nil
+		}
+		err := wrap(cd.db.Create(&counter{Name: key, Value: 1, ExpiresAt: now.Add(window)}).Error)
+		if err == nil {
+			return 1, nil
+		} else if !errors.Is(err, ErrConflict) {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("counter %s is contended", key)
+}
+
+func (cd *Counter) DeleteExpired(now time.Time) (int64, error) {
+	res := cd.db.Where("counters.expires_at <= ?", now.UTC()).Delete(&counter{})
+	return res.RowsAffected, wrap(res.Error)
+}
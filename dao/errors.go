@@ -0,0 +1,107 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// the kinds of errors returned by the repositories, test them with errors.Is
+// as the driver error is wrapped
+var (
+	// no row match
+	ErrNotFound = errors.New("not found")
+	// a primary or unique key is already used
+	ErrConflict = errors.New("conflict")
+	// the row was changed since it was read, read it again before updating
+	ErrStale = errors.New("stale version")
+	// the database cannot be reached or is overloaded, the request can be
+	// retried later
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// Error wrap a driver error with its kind
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// wrap give a kind to the errors of gorm and the drivers, the others are
+// returned unchanged
+func wrap(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case gorm.IsRecordNotFoundError(err):
+		return &Error{ErrNotFound, err}
+	case isConflict(err):
+		return &Error{ErrConflict, err}
+	case isUnavailable(err):
+		return &Error{ErrUnavailable, err}
+	}
+	return err
+}
+
+func isConflict(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	var pqErr *pq.Error
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.As(err, &mysqlErr):
+		// ER_DUP_ENTRY
+		return mysqlErr.Number == 1062
+	case errors.As(err, &pqErr):
+		// unique_violation
+		return pqErr.Code == "23505"
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+func isUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	var mysqlErr *mysql.MySQLError
+	var pqErr *pq.Error
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.As(err, &netErr):
+		return true
+	case errors.As(err, &mysqlErr):
+		// ER_CON_COUNT_ERROR, ER_LOCK_WAIT_TIMEOUT
+		return mysqlErr.Number == 1040 || mysqlErr.Number == 1205
+	case errors.As(err, &pqErr):
+		// connection_exception, insufficient_resources, operator_intervention
+		switch pqErr.Code.Class() {
+		case "08", "53", "57":
+			return true
+		}
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
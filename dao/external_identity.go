@@ -0,0 +1,83 @@
+package dao
+
+import (
+	"fmt"
+
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pii"
+	"github.com/jinzhu/gorm"
+)
+
+type ExternalIdentity struct {
+	db     *gorm.DB
+	cipher *pii.Cipher
+}
+
+// NewExternalIdentityDao return the external identities dao, the emails are
+// stored in clear if cipher is nil
+func NewExternalIdentityDao(db *gorm.DB, cipher *pii.Cipher) *ExternalIdentity {
+	return &ExternalIdentity{db: db, cipher: cipher}
+}
+
+func (eid *ExternalIdentity) GetByIssuerAndSubject(issuer, subject string) (domain.ExternalIdentity, error) {
+	ei := domain.ExternalIdentity{}
+	err := eid.db.Where("external_identities.issuer = ? AND external_identities.subject = ?", issuer, subject).
+		First(&ei).Error
+	if err != nil {
+		return ei, wrap(err)
+	}
+	if ei.Email, err = eid.cipher.Decrypt("external_identities.email", ei.Email); err != nil {
+		return ei, fmt.Errorf("unable to decrypt email of external identity [id=%s]: %s", ei.Id, err.Error())
+	}
+	return ei, nil
+}
+
+func (eid *ExternalIdentity) Create(ei domain.ExternalIdentity) error {
+	var err error
+	if ei.Email, err = eid.cipher.Encrypt("external_identities.email", ei.Email); err != nil {
+		return err
+	}
+	return wrap(eid.db.Create(&ei).Error)
+}
+
+func (eid *ExternalIdentity) DeleteByUserId(userId string) error {
+	return wrap(eid.db.Where("external_identities.user_id = ?", userId).Delete(&domain.ExternalIdentity{}).Error)
+}
+
+// Reencrypt encrypt again the emails which are in clear or use an old key,
+// by batches. It return how many identities were updated.
+func (eid *ExternalIdentity) Reencrypt(batch int) (int64, error) {
+	var updated int64
+	last := ""
+	for {
+		eis := []domain.ExternalIdentity{}
+		err := eid.db.Where("external_identities.id > ?", last).
+			Order("external_identities.id").Limit(batch).Find(&eis).Error
+		if err != nil {
+			return updated, wrap(err)
+		}
+		for _, ei := range eis {
+			if !eid.cipher.Stale(ei.Email) {
+				continue
+			}
+			email, err := eid.cipher.Decrypt("external_identities.email", ei.Email)
+			if err != nil {
+				return updated, fmt.Errorf("unable to decrypt email of external identity [id=%s]: %s",
+					ei.Id, err.Error())
+			}
+			if email, err = eid.cipher.Encrypt("external_identities.email", email); err != nil {
+				return updated, err
+			}
+			err = eid.db.Model(&domain.ExternalIdentity{}).Where("external_identities.id = ?", ei.Id).
+				UpdateColumn("email", email).Error
+			if err != nil {
+				return updated, wrap(err)
+			}
+			updated++
+		}
+		if len(eis) < batch {
+			return updated, nil
+		}
+		last = eis[len(eis)-1].Id
+	}
+}
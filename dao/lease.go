@@ -0,0 +1,62 @@
+package dao
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// lease is a row of the leases table
+type lease struct {
+	Name      string `gorm:"primary_key"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (lease) TableName() string {
+	return "leases"
+}
+
+type Lease struct {
+	db *gorm.DB
+}
+
+func NewLeaseDao(db *gorm.DB) *Lease {
+	return &Lease{db: db}
+}
+
+func (ld *Lease) Acquire(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	// renew our lease or take an expired one
+	res := ld.db.Model(&lease{}).
+		Where("leases.name = ? AND (leases.holder = ? OR leases.expires_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires_at": now.Add(ttl)})
+	if res.Error != nil {
+		return false, wrap(res.Error)
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// nobody took it yet, only one of the replicas can insert the row
+	var count int
+	if err := ld.db.Model(&lease{}).Where("leases.name = ?", name).Count(&count).Error; err != nil {
+		return false, wrap(err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+	err := wrap(ld.db.Create(&lease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}).Error)
+	if errors.Is(err, ErrConflict) {
+		// another replica was faster
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ld *Lease) Release(name, holder string) error {
+	return wrap(ld.db.Where("leases.name = ? AND leases.holder = ?", name, holder).Delete(&lease{}).Error)
+}
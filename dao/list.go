@@ -0,0 +1,94 @@
+package dao
+
+import (
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+)
+
+// how the lists can be sorted and filtered, the handlers parse the query
+// string with them and the daos fetch the columns with the *Column funcs
+
+// the emails may be encrypted, they cannot be sorted
+var UserList = pagination.Spec{
+	IdColumn: "users.id",
+	Sorts: map[string]string{
+		"created_at": "users.created_at",
+		"username":   "users.username",
+	},
+	DefaultSort: "created_at",
+	Filters: map[string]pagination.Filter{
+		"username":       {Column: "users.username"},
+		"email":          {Column: "users.email"},
+		"created_after":  {Column: "users.created_at", Op: pagination.Gte, Time: true},
+		"created_before": {Column: "users.created_at", Op: pagination.Lt, Time: true},
+	},
+}
+
+func UserColumn(u domain.User, column string) interface{} {
+	switch column {
+	case "users.id":
+		return u.Id
+	case "users.username":
+		return u.Username
+	case "users.email":
+		return u.Email
+	case "users.created_at":
+		return u.CreatedAt
+	}
+	return nil
+}
+
+// the token ids are secrets, they are never filtered on
+var AccessTokenList = pagination.Spec{
+	IdColumn: "access_tokens.id",
+	Sorts: map[string]string{
+		"created_at": "access_tokens.created_at",
+		"expires_at": "access_tokens.expires_at",
+	},
+	DefaultSort: "-created_at",
+}
+
+func AccessTokenColumn(at domain.AccessToken, column string) interface{} {
+	switch column {
+	case "access_tokens.id":
+		return at.Id
+	case "access_tokens.user_id":
+		return at.UserId
+	case "access_tokens.created_at":
+		return at.CreatedAt
+	case "access_tokens.expires_at":
+		return at.ExpiresAt
+	}
+	return nil
+}
+
+var AuditEventList = pagination.Spec{
+	IdColumn: "audit_events.id",
+	Sorts: map[string]string{
+		"created_at": "audit_events.created_at",
+	},
+	DefaultSort: "-created_at",
+	Filters: map[string]pagination.Filter{
+		"action":   {Column: "audit_events.action"},
+		"actor_id": {Column: "audit_events.actor_id"},
+		"user_id":  {Column: "audit_events.user_id"},
+		"since":    {Column: "audit_events.created_at", Op: pagination.Gte, Time: true},
+		"until":    {Column: "audit_events.created_at", Op: pagination.Lt, Time: true},
+	},
+}
+
+func AuditEventColumn(e domain.AuditEvent, column string) interface{} {
+	switch column {
+	case "audit_events.id":
+		return e.Id
+	case "audit_events.action":
+		return e.Action
+	case "audit_events.actor_id":
+		return e.ActorId
+	case "audit_events.user_id":
+		return e.UserId
+	case "audit_events.created_at":
+		return e.CreatedAt
+	}
+	return nil
+}
@@ -0,0 +1,629 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+)
+
+// store hold all the tables, one lock for everything is enough for the
+// tests and the dev mode
+type store struct {
+	mutex               sync.RWMutex
+	users               map[string]domain.User
+	accessTokens        map[string]domain.AccessToken
+	signupVerifications map[string]domain.UserSignupVerification
+	externalIdentities  map[string]domain.ExternalIdentity
+	userPermissions     map[string]domain.UserPermission
+	leases              map[string]lease
+	auditEvents         map[string]domain.AuditEvent
+	counters            map[string]counter
+}
+
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type counter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// NewRepositories return empty repositories kept in memory, safe for
+// concurrent use
+func NewRepositories() dao.Repositories {
+	s := &store{
+		users:               map[string]domain.User{},
+		accessTokens:        map[string]domain.AccessToken{},
+		signupVerifications: map[string]domain.UserSignupVerification{},
+		externalIdentities:  map[string]domain.ExternalIdentity{},
+		userPermissions:     map[string]domain.UserPermission{},
+		leases:              map[string]lease{},
+		auditEvents:         map[string]domain.AuditEvent{},
+		counters:            map[string]counter{},
+	}
+	repos := s.repositories()
+	repos.RunInTx = s.runInTx
+	return repos
+}
+
+func (s *store) repositories() dao.Repositories {
+	return dao.Repositories{
+		Users:               &User{s},
+		AccessTokens:        &AccessToken{s},
+		SignupVerifications: &UserSignupVerification{s},
+		ExternalIdentities:  &ExternalIdentity{s},
+		UserPermissions:     &UserPermission{s},
+		Leases:              &Lease{s},
+		AuditEvents:         &AuditEvent{s},
+		Counters:            &Counter{s},
+	}
+}
+
+func (s *store) clone() *store {
+	c := &store{
+		users:               map[string]domain.User{},
+		accessTokens:        map[string]domain.AccessToken{},
+		signupVerifications: map[string]domain.UserSignupVerification{},
+		externalIdentities:  map[string]domain.ExternalIdentity{},
+		userPermissions:     map[string]domain.UserPermission{},
+		leases:              map[string]lease{},
+		auditEvents:         map[string]domain.AuditEvent{},
+		counters:            map[string]counter{},
+	}
+	for k, v := range s.users {
+		c.users[k] = v
+	}
+	for k, v := range s.accessTokens {
+		c.accessTokens[k] = v
+	}
+	for k, v := range s.signupVerifications {
+		c.signupVerifications[k] = v
+	}
+	for k, v := range s.externalIdentities {
+		c.externalIdentities[k] = v
+	}
+	for k, v := range s.userPermissions {
+		c.userPermissions[k] = v
+	}
+	for k, v := range s.leases {
+		c.leases[k] = v
+	}
+	for k, v := range s.auditEvents {
+		c.auditEvents[k] = v
+	}
+	for k, v := range s.counters {
+		c.counters[k] = v
+	}
+	return c
+}
+
+// runInTx run fn on a copy of the tables which replace them if fn succeed.
+// The store is locked until the end so the transactions are serialized, fn
+// must only use the tx repositories or it will deadlock.
+func (s *store) runInTx(fn func(tx dao.Repositories) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.clone()
+	tx := c.repositories()
+	tx.RunInTx = func(fn func(tx dao.Repositories) error) error {
+		return fn(tx)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.users = c.users
+	s.accessTokens = c.accessTokens
+	s.signupVerifications = c.signupVerifications
+	s.externalIdentities = c.externalIdentities
+	s.userPermissions = c.userPermissions
+	s.leases = c.leases
+	s.auditEvents = c.auditEvents
+	s.counters = c.counters
+	return nil
+}
+
+type User struct {
+	s *store
+}
+
+// the first user matching by creation date, like the sql First
+func (ud *User) first(match func(domain.User) bool) (domain.User, error) {
+	ud.s.mutex.RLock()
+	defer ud.s.mutex.RUnlock()
+	found := []domain.User{}
+	for _, u := range ud.s.users {
+		if u.DeletedAt == nil && match(u) {
+			found = append(found, u)
+		}
+	}
+	if len(found) == 0 {
+		return domain.User{}, dao.ErrNotFound
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].CreatedAt.Before(found[j].CreatedAt)
+	})
+	return found[0], nil
+}
+
+func (ud *User) GetById(id string) (domain.User, error) {
+	return ud.first(func(u domain.User) bool { return u.Id == id })
+}
+
+func (ud *User) GetByEmailOrUsername(str string) (domain.User, error) {
+	return ud.first(func(u domain.User) bool { return u.Email == str || u.Username == str })
+}
+
+func (ud *User) GetByMail(email string) (domain.User, error) {
+	return ud.first(func(u domain.User) bool { return u.Email == email })
+}
+
+func (ud *User) GetByUsername(username string) (domain.User, error) {
+	return ud.first(func(u domain.User) bool { return u.Username == username })
+}
+
+func (ud *User) Create(u domain.User) error {
+	ud.s.mutex.Lock()
+	defer ud.s.mutex.Unlock()
+	if _, ok := ud.s.users[u.Id]; ok {
+		return dao.ErrConflict
+	}
+	ud.s.users[u.Id] = u
+	return nil
+}
+
+func (ud *User) Update(u domain.User) (domain.User, error) {
+	ud.s.mutex.Lock()
+	defer ud.s.mutex.Unlock()
+	old, ok := ud.s.users[u.Id]
+	if !ok || old.DeletedAt != nil {
+		return u, dao.ErrNotFound
+	}
+	if old.Version != u.Version {
+		return u, dao.ErrStale
+	}
+	// only the columns the gorm dao update
+	old.Username, old.Email, old.Password, old.UpdatedAt = u.Username, u.Email, u.Password, u.UpdatedAt
+	old.Version++
+	ud.s.users[u.Id] = old
+	return old, nil
+}
+
+func (ud *User) Delete(id string) error {
+	ud.s.mutex.Lock()
+	defer ud.s.mutex.Unlock()
+	if u, ok := ud.s.users[id]; ok && u.DeletedAt == nil {
+		now := time.Now().UTC()
+		u.DeletedAt = &now
+		u.Version++
+		ud.s.users[id] = u
+	}
+	return nil
+}
+
+func (ud *User) Restore(id string) error {
+	ud.s.mutex.Lock()
+	defer ud.s.mutex.Unlock()
+	u, ok := ud.s.users[id]
+	if !ok || u.DeletedAt == nil {
+		return dao.ErrNotFound
+	}
+	u.DeletedAt = nil
+	u.Version++
+	ud.s.users[id] = u
+	return nil
+}
+
+func (ud *User) Purge(id string) error {
+	ud.s.mutex.Lock()
+	defer ud.s.mutex.Unlock()
+	delete(ud.s.users, id)
+	return nil
+}
+
+func (ud *User) GetDeletedBefore(t time.Time, limit int) ([]domain.User, error) {
+	ud.s.mutex.RLock()
+	defer ud.s.mutex.RUnlock()
+	us := []domain.User{}
+	for _, u := range ud.s.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(t) {
+			us = append(us, u)
+		}
+	}
+	sort.Slice(us, func(i, j int) bool {
+		return us[i].DeletedAt.Before(*us[j].DeletedAt)
+	})
+	if len(us) > limit {
+		us = us[:limit]
+	}
+	return us, nil
+}
+
+// used checks the deleted users too
+func (ud *User) used(match func(domain.User) bool) (bool, error) {
+	ud.s.mutex.RLock()
+	defer ud.s.mutex.RUnlock()
+	for _, u := range ud.s.users {
+		if match(u) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ud *User) IsEmailUsed(email string) (bool, error) {
+	return ud.used(func(u domain.User) bool { return u.Email == email })
+}
+
+func (ud *User) IsUsernameUsed(username string) (bool, error) {
+	return ud.used(func(u domain.User) bool { return u.Username == username })
+}
+
+func (ud *User) List(page pagination.Page) ([]domain.User, string, error) {
+	ud.s.mutex.RLock()
+	defer ud.s.mutex.RUnlock()
+	all := []domain.User{}
+	for _, u := range ud.s.users {
+		if u.DeletedAt == nil {
+			all = append(all, u)
+		}
+	}
+	column := func(i int, column string) interface{} { return dao.UserColumn(all[i], column) }
+	us := []domain.User{}
+	for _, i := range page.Select(len(all), column) {
+		us = append(us, all[i])
+	}
+	n, next := page.Next(len(us), func(i int, column string) interface{} {
+		return dao.UserColumn(us[i], column)
+	})
+	return us[:n], next, nil
+}
+
+type AccessToken struct {
+	s *store
+}
+
+func (atd *AccessToken) GetById(id string) (domain.AccessToken, error) {
+	atd.s.mutex.RLock()
+	defer atd.s.mutex.RUnlock()
+	if at, ok := atd.s.accessTokens[id]; ok {
+		return at, nil
+	}
+	return domain.AccessToken{}, dao.ErrNotFound
+}
+
+func (atd *AccessToken) GetByUserId(userId string) (domain.AccessToken, error) {
+	atd.s.mutex.RLock()
+	defer atd.s.mutex.RUnlock()
+	for _, at := range atd.s.accessTokens {
+		if at.UserId == userId {
+			return at, nil
+		}
+	}
+	return domain.AccessToken{}, dao.ErrNotFound
+}
+
+func (atd *AccessToken) Create(at domain.AccessToken) error {
+	atd.s.mutex.Lock()
+	defer atd.s.mutex.Unlock()
+	if _, ok := atd.s.accessTokens[at.Id]; ok {
+		return dao.ErrConflict
+	}
+	atd.s.accessTokens[at.Id] = at
+	return nil
+}
+
+func (atd *AccessToken) Delete(id string) error {
+	atd.s.mutex.Lock()
+	defer atd.s.mutex.Unlock()
+	delete(atd.s.accessTokens, id)
+	return nil
+}
+
+func (atd *AccessToken) DeleteByUserId(userId string) error {
+	atd.s.mutex.Lock()
+	defer atd.s.mutex.Unlock()
+	for id, at := range atd.s.accessTokens {
+		if at.UserId == userId {
+			delete(atd.s.accessTokens, id)
+		}
+	}
+	return nil
+}
+
+func (atd *AccessToken) DeleteExpired(now time.Time) (int64, error) {
+	atd.s.mutex.Lock()
+	defer atd.s.mutex.Unlock()
+	var n int64
+	for id, at := range atd.s.accessTokens {
+		if at.ExpiresAt.Before(now) {
+			delete(atd.s.accessTokens, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (atd *AccessToken) List(page pagination.Page) ([]domain.AccessToken, string, error) {
+	atd.s.mutex.RLock()
+	defer atd.s.mutex.RUnlock()
+	all := []domain.AccessToken{}
+	for _, at := range atd.s.accessTokens {
+		all = append(all, at)
+	}
+	column := func(i int, column string) interface{} { return dao.AccessTokenColumn(all[i], column) }
+	ats := []domain.AccessToken{}
+	for _, i := range page.Select(len(all), column) {
+		ats = append(ats, all[i])
+	}
+	n, next := page.Next(len(ats), func(i int, column string) interface{} {
+		return dao.AccessTokenColumn(ats[i], column)
+	})
+	return ats[:n], next, nil
+}
+
+type UserSignupVerification struct {
+	s *store
+}
+
+func (usvd *UserSignupVerification) GetById(id string) (domain.UserSignupVerification, error) {
+	usvd.s.mutex.RLock()
+	defer usvd.s.mutex.RUnlock()
+	if usv, ok := usvd.s.signupVerifications[id]; ok {
+		return usv, nil
+	}
+	return domain.UserSignupVerification{}, dao.ErrNotFound
+}
+
+func (usvd *UserSignupVerification) GetByUserId(userId string) (domain.UserSignupVerification, error) {
+	usvd.s.mutex.RLock()
+	defer usvd.s.mutex.RUnlock()
+	for _, usv := range usvd.s.signupVerifications {
+		if usv.UserId == userId {
+			return usv, nil
+		}
+	}
+	return domain.UserSignupVerification{}, dao.ErrNotFound
+}
+
+func (usvd *UserSignupVerification) GetExpired(now time.Time, limit int) ([]domain.UserSignupVerification, error) {
+	usvd.s.mutex.RLock()
+	defer usvd.s.mutex.RUnlock()
+	usvs := []domain.UserSignupVerification{}
+	for _, usv := range usvd.s.signupVerifications {
+		if usv.ExpiresAt.Before(now) && !usv.EmailChange {
+			usvs = append(usvs, usv)
+		}
+	}
+	sort.Slice(usvs, func(i, j int) bool {
+		return usvs[i].ExpiresAt.Before(usvs[j].ExpiresAt)
+	})
+	if len(usvs) > limit {
+		usvs = usvs[:limit]
+	}
+	return usvs, nil
+}
+
+func (usvd *UserSignupVerification) Create(usv domain.UserSignupVerification) error {
+	usvd.s.mutex.Lock()
+	defer usvd.s.mutex.Unlock()
+	if _, ok := usvd.s.signupVerifications[usv.Id]; ok {
+		return dao.ErrConflict
+	}
+	usvd.s.signupVerifications[usv.Id] = usv
+	return nil
+}
+
+func (usvd *UserSignupVerification) Delete(id string) error {
+	usvd.s.mutex.Lock()
+	defer usvd.s.mutex.Unlock()
+	delete(usvd.s.signupVerifications, id)
+	return nil
+}
+
+func (usvd *UserSignupVerification) DeleteByUserId(userId string) error {
+	usvd.s.mutex.Lock()
+	defer usvd.s.mutex.Unlock()
+	for id, usv := range usvd.s.signupVerifications {
+		if usv.UserId == userId {
+			delete(usvd.s.signupVerifications, id)
+		}
+	}
+	return nil
+}
+
+type ExternalIdentity struct {
+	s *store
+}
+
+func (eid *ExternalIdentity) GetByIssuerAndSubject(issuer, subject string) (domain.ExternalIdentity, error) {
+	eid.s.mutex.RLock()
+	defer eid.s.mutex.RUnlock()
+	for _, ei := range eid.s.externalIdentities {
+		if ei.Issuer == issuer && ei.Subject == subject {
+			return ei, nil
+		}
+	}
+	return domain.ExternalIdentity{}, dao.ErrNotFound
+}
+
+func (eid *ExternalIdentity) Create(ei domain.ExternalIdentity) error {
+	eid.s.mutex.Lock()
+	defer eid.s.mutex.Unlock()
+	if _, ok := eid.s.externalIdentities[ei.Id]; ok {
+		return dao.ErrConflict
+	}
+	// unique (issuer, subject)
+	for _, other := range eid.s.externalIdentities {
+		if other.Issuer == ei.Issuer && other.Subject == ei.Subject {
+			return dao.ErrConflict
+		}
+	}
+	eid.s.externalIdentities[ei.Id] = ei
+	return nil
+}
+
+func (eid *ExternalIdentity) DeleteByUserId(userId string) error {
+	eid.s.mutex.Lock()
+	defer eid.s.mutex.Unlock()
+	for id, ei := range eid.s.externalIdentities {
+		if ei.UserId == userId {
+			delete(eid.s.externalIdentities, id)
+		}
+	}
+	return nil
+}
+
+type UserPermission struct {
+	s *store
+}
+
+func (upd *UserPermission) GetByUserId(userId string) ([]domain.UserPermission, error) {
+	upd.s.mutex.RLock()
+	defer upd.s.mutex.RUnlock()
+	ups := []domain.UserPermission{}
+	for _, up := range upd.s.userPermissions {
+		if up.UserId == userId {
+			ups = append(ups, up)
+		}
+	}
+	return ups, nil
+}
+
+func (upd *UserPermission) GetByUserIdAndPermission(userId, permission string) (domain.UserPermission, error) {
+	upd.s.mutex.RLock()
+	defer upd.s.mutex.RUnlock()
+	for _, up := range upd.s.userPermissions {
+		if up.UserId == userId && up.Permission == permission {
+			return up, nil
+		}
+	}
+	return domain.UserPermission{}, dao.ErrNotFound
+}
+
+func (upd *UserPermission) Create(up domain.UserPermission) error {
+	upd.s.mutex.Lock()
+	defer upd.s.mutex.Unlock()
+	if _, ok := upd.s.userPermissions[up.Id]; ok {
+		return dao.ErrConflict
+	}
+	// unique (user_id, permission)
+	for _, other := range upd.s.userPermissions {
+		if other.UserId == up.UserId && other.Permission == up.Permission {
+			return dao.ErrConflict
+		}
+	}
+	upd.s.userPermissions[up.Id] = up
+	return nil
+}
+
+func (upd *UserPermission) Delete(id string) error {
+	upd.s.mutex.Lock()
+	defer upd.s.mutex.Unlock()
+	delete(upd.s.userPermissions, id)
+	return nil
+}
+
+func (upd *UserPermission) DeleteByUserId(userId string) error {
+	upd.s.mutex.Lock()
+	defer upd.s.mutex.Unlock()
+	for id, up := range upd.s.userPermissions {
+		if up.UserId == userId {
+			delete(upd.s.userPermissions, id)
+		}
+	}
+	return nil
+}
+
+type Lease struct {
+	s *store
+}
+
+func (ld *Lease) Acquire(name, holder string, ttl time.Duration) (bool, error) {
+	ld.s.mutex.Lock()
+	defer ld.s.mutex.Unlock()
+	now := time.Now()
+	if l, ok := ld.s.leases[name]; ok && l.holder != holder && now.Before(l.expiresAt) {
+		return false, nil
+	}
+	ld.s.leases[name] = lease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (ld *Lease) Release(name, holder string) error {
+	ld.s.mutex.Lock()
+	defer ld.s.mutex.Unlock()
+	if l, ok := ld.s.leases[name]; ok && l.holder == holder {
+		delete(ld.s.leases, name)
+	}
+	return nil
+}
+
+type Counter struct {
+	s *store
+}
+
+func (cd *Counter) Incr(key string, window time.Duration) (int64, error) {
+	cd.s.mutex.Lock()
+	defer cd.s.mutex.Unlock()
+	now := time.Now()
+	c, ok := cd.s.counters[key]
+	if !ok || !now.Before(c.expiresAt) {
+		c = counter{expiresAt: now.Add(window)}
+	}
+	c.value++
+	cd.s.counters[key] = c
+	return c.value, nil
+}
+
+func (cd *Counter) DeleteExpired(now time.Time) (int64, error) {
+	cd.s.mutex.Lock()
+	defer cd.s.mutex.Unlock()
+	var n int64
+	for key, c := range cd.s.counters {
+		if !now.Before(c.expiresAt) {
+			delete(cd.s.counters, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type AuditEvent struct {
+	s *store
+}
+
+func (aed *AuditEvent) Create(e domain.AuditEvent) error {
+	aed.s.mutex.Lock()
+	defer aed.s.mutex.Unlock()
+	if _, ok := aed.s.auditEvents[e.Id]; ok {
+		return dao.ErrConflict
+	}
+	aed.s.auditEvents[e.Id] = e
+	return nil
+}
+
+func (aed *AuditEvent) List(page pagination.Page) ([]domain.AuditEvent, string, error) {
+	aed.s.mutex.RLock()
+	defer aed.s.mutex.RUnlock()
+	all := []domain.AuditEvent{}
+	for _, e := range aed.s.auditEvents {
+		all = append(all, e)
+	}
+	column := func(i int, column string) interface{} { return dao.AuditEventColumn(all[i], column) }
+	es := []domain.AuditEvent{}
+	for _, i := range page.Select(len(all), column) {
+		es = append(es, all[i])
+	}
+	n, next := page.Next(len(es), func(i int, column string) interface{} {
+		return dao.AuditEventColumn(es[i], column)
+	})
+	return es[:n], next, nil
+}
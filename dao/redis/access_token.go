@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// AccessToken keep each token as json in a key which expire with the token.
+// The ids of the tokens of a user are in a sorted set by expiration, the
+// expired ones are removed from it on the next token of the user or by the
+// janitor.
+type AccessToken struct {
+	client *goredis.Client
+	prefix string
+}
+
+func NewAccessTokenDao(client *goredis.Client, prefix string) *AccessToken {
+	return &AccessToken{client: client, prefix: prefix}
+}
+
+func (atd *AccessToken) tokenKey(id string) string {
+	return atd.prefix + "access_token:" + id
+}
+
+func (atd *AccessToken) userKey(userId string) string {
+	return atd.prefix + "user_access_tokens:" + userId
+}
+
+// the sorted sets are scored by expiration in milliseconds
+func score(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func (atd *AccessToken) GetById(id string) (domain.AccessToken, error) {
+	at := domain.AccessToken{}
+	raw, err := atd.client.Get(context.Background(), atd.tokenKey(id)).Bytes()
+	if err != nil {
+		return at, wrap(err)
+	}
+	return at, json.Unmarshal(raw, &at)
+}
+
+// byUser return the tokens of the user which are not expired
+func (atd *AccessToken) byUser(userId string) ([]domain.AccessToken, error) {
+	ctx := context.Background()
+	ids, err := atd.client.ZRangeByScore(ctx, atd.userKey(userId), &goredis.ZRangeBy{
+		Min: score(time.Now()),
+		Max: "+inf",
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, wrap(err)
+	}
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, atd.tokenKey(id))
+	}
+	values, err := atd.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, wrap(err)
+	}
+	ats := []domain.AccessToken{}
+	for _, v := range values {
+		// deleted or expired meanwhile
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		at := domain.AccessToken{}
+		if err := json.Unmarshal([]byte(raw), &at); err != nil {
+			return nil, err
+		}
+		ats = append(ats, at)
+	}
+	return ats, nil
+}
+
+func (atd *AccessToken) GetByUserId(userId string) (domain.AccessToken, error) {
+	ats, err := atd.byUser(userId)
+	if err != nil {
+		return domain.AccessToken{}, err
+	}
+	if len(ats) == 0 {
+		return domain.AccessToken{}, dao.ErrNotFound
+	}
+	return ats[0], nil
+}
+
+func (atd *AccessToken) Create(at domain.AccessToken) error {
+	raw, err := json.Marshal(at)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(at.ExpiresAt)
+	if ttl <= 0 {
+		// already expired, SET refuse a ttl of zero
+		ttl = time.Millisecond
+	}
+	var created *goredis.BoolCmd
+	_, err = atd.client.TxPipelined(context.Background(), func(pipe goredis.Pipeliner) error {
+		ctx := context.Background()
+		created = pipe.SetNX(ctx, atd.tokenKey(at.Id), raw, ttl)
+		pipe.ZAdd(ctx, atd.userKey(at.UserId), goredis.Z{
+			Score:  float64(at.ExpiresAt.UnixMilli()),
+			Member: at.Id,
+		})
+		pipe.ZRemRangeByScore(ctx, atd.userKey(at.UserId), "-inf", "("+score(time.Now()))
+		return nil
+	})
+	if err != nil {
+		return wrap(err)
+	}
+	if !created.Val() {
+		return dao.ErrConflict
+	}
+	return nil
+}
+
+func (atd *AccessToken) Delete(id string) error {
+	at, err := atd.GetById(id)
+	if err != nil {
+		// expired or already deleted, the janitor clean the sorted set
+		if errors.Is(err, dao.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	_, err = atd.client.TxPipelined(context.Background(), func(pipe goredis.Pipeliner) error {
+		ctx := context.Background()
+		pipe.Del(ctx, atd.tokenKey(id))
+		pipe.ZRem(ctx, atd.userKey(at.UserId), id)
+		return nil
+	})
+	return wrap(err)
+}
+
+func (atd *AccessToken) DeleteByUserId(userId string) error {
+	ctx := context.Background()
+	ids, err := atd.client.ZRange(ctx, atd.userKey(userId), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return wrap(err)
+	}
+	keys := []string{}
+	members := []interface{}{}
+	for _, id := range ids {
+		keys = append(keys, atd.tokenKey(id))
+		members = append(members, id)
+	}
+	// only remove what was read, a token created meanwhile stay indexed
+	_, err = atd.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.ZRem(ctx, atd.userKey(userId), members...)
+		return nil
+	})
+	return wrap(err)
+}
+
+// DeleteExpired only clean the sorted sets, the tokens expire by themselves.
+// It return the number of expired tokens removed from the sets.
+func (atd *AccessToken) DeleteExpired(now time.Time) (int64, error) {
+	ctx := context.Background()
+	var removed int64
+	iter := atd.client.Scan(ctx, 0, atd.userKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		n, err := atd.client.ZRemRangeByScore(ctx, iter.Val(), "-inf", "("+score(now)).Result()
+		if err != nil {
+			return removed, wrap(err)
+		}
+		removed += n
+	}
+	return removed, wrap(iter.Err())
+}
+
+// List need the user of the tokens in the page conditions, the tokens are
+// only indexed by user
+func (atd *AccessToken) List(page pagination.Page) ([]domain.AccessToken, string, error) {
+	all := []domain.AccessToken{}
+	for _, c := range page.Conditions {
+		if c.Column != "access_tokens.user_id" || c.Op != pagination.Eq {
+			continue
+		}
+		userId, _ := c.Value.(string)
+		ats, err := atd.byUser(userId)
+		if err != nil {
+			return nil, "", err
+		}
+		all = append(all, ats...)
+	}
+	column := func(i int, column string) interface{} { return dao.AccessTokenColumn(all[i], column) }
+	ats := []domain.AccessToken{}
+	for _, i := range page.Select(len(all), column) {
+		ats = append(ats, all[i])
+	}
+	n, next := page.Next(len(ats), func(i int, column string) interface{} {
+		return dao.AccessTokenColumn(ats[i], column)
+	})
+	return ats[:n], next, nil
+}
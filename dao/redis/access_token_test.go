@@ -0,0 +1,142 @@
+package redis
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+)
+
+func TestAccessTokenCreate(t *testing.T) {
+	mr, client := newTestClient(t)
+	tokens := NewAccessTokenDao(client, defaultPrefix)
+	at := domain.NewAccessToken("token", "alice", 60, time.Now())
+
+	if err := tokens.Create(at); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Create(at); !errors.Is(err, dao.ErrConflict) {
+		t.Fatalf("expected %v, got %v", dao.ErrConflict, err)
+	}
+	got, err := tokens.GetById("token")
+	if err != nil || got.UserId != "alice" || !got.ExpiresAt.Equal(at.ExpiresAt) {
+		t.Fatalf("unexpected token %+v: %v", got, err)
+	}
+	if _, err := tokens.GetById("unknown"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dao.ErrNotFound, err)
+	}
+	// the key expire with the token
+	if ttl := mr.TTL(defaultPrefix + "access_token:token"); ttl <= 0 || ttl > 60*time.Second {
+		t.Fatalf("unexpected ttl %s", ttl)
+	}
+	if got, err := tokens.GetByUserId("alice"); err != nil || got.Id != "token" {
+		t.Fatalf("unexpected token %+v: %v", got, err)
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	mr, client := newTestClient(t)
+	tokens := NewAccessTokenDao(client, defaultPrefix)
+	tokens.Create(domain.NewAccessToken("short", "alice", 60, time.Now()))
+	tokens.Create(domain.NewAccessToken("long", "alice", 3600, time.Now()))
+
+	mr.FastForward(61 * time.Second)
+	if _, err := tokens.GetById("short"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the expired token to be gone, got %v", err)
+	}
+	if _, err := tokens.GetById("long"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the janitor prune the index of the user
+	removed, err := tokens.DeleteExpired(time.Now().Add(61 * time.Second))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected one expired token removed, got %d: %v", removed, err)
+	}
+	if members, _ := mr.ZMembers(defaultPrefix + "user_access_tokens:alice"); len(members) != 1 || members[0] != "long" {
+		t.Fatalf("unexpected index %v", members)
+	}
+}
+
+func TestAccessTokenDelete(t *testing.T) {
+	mr, client := newTestClient(t)
+	tokens := NewAccessTokenDao(client, defaultPrefix)
+	tokens.Create(domain.NewAccessToken("a1", "alice", 3600, time.Now()))
+	tokens.Create(domain.NewAccessToken("a2", "alice", 3600, time.Now()))
+	tokens.Create(domain.NewAccessToken("b1", "bob", 3600, time.Now()))
+
+	if err := tokens.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.GetById("a1"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the token to be deleted, got %v", err)
+	}
+	// already gone
+	if err := tokens.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tokens.DeleteByUserId("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.GetById("a2"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the tokens of alice to be deleted, got %v", err)
+	}
+	if mr.Exists(defaultPrefix + "user_access_tokens:alice") {
+		t.Fatalf("expected the index of alice to be removed")
+	}
+	if _, err := tokens.GetById("b1"); err != nil {
+		t.Fatalf("expected the tokens of bob to be kept: %s", err)
+	}
+}
+
+func TestAccessTokenList(t *testing.T) {
+	_, client := newTestClient(t)
+	tokens := NewAccessTokenDao(client, defaultPrefix)
+	now := time.Now()
+	tokens.Create(domain.NewAccessToken("a1", "alice", 3600, now.Add(-time.Minute)))
+	tokens.Create(domain.NewAccessToken("a2", "alice", 3600, now))
+	tokens.Create(domain.NewAccessToken("b1", "bob", 3600, now))
+
+	page, _ := pagination.Parse(url.Values{"limit": {"1"}}, dao.AccessTokenList)
+	ats, next, err := tokens.List(page.With("access_tokens.user_id", "alice"))
+	if err != nil || len(ats) != 1 || ats[0].Id != "a2" || next == "" {
+		t.Fatalf("expected the latest token of alice with a cursor, got %v %q: %v", ats, next, err)
+	}
+	page, _ = pagination.Parse(url.Values{"limit": {"1"}, "cursor": {next}}, dao.AccessTokenList)
+	ats, next, err = tokens.List(page.With("access_tokens.user_id", "alice"))
+	if err != nil || len(ats) != 1 || ats[0].Id != "a1" || next != "" {
+		t.Fatalf("expected the last token of alice, got %v %q: %v", ats, next, err)
+	}
+
+	// the tokens are only indexed by user
+	page, _ = pagination.Parse(url.Values{}, dao.AccessTokenList)
+	if ats, _, err := tokens.List(page); err != nil || len(ats) != 0 {
+		t.Fatalf("expected no token without user, got %v: %v", ats, err)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	_, client := newTestClient(t)
+	repos := NewRepositories(memory.NewRepositories(), client, Config{})
+	repos.AccessTokens.Create(domain.NewAccessToken("token", "alice", 3600, time.Now()))
+
+	// the transactions use redis too, without rolling it back
+	err := repos.WithTx(func(tx dao.Repositories) error {
+		if err := tx.AccessTokens.DeleteByUserId("alice"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatalf("expected the error of the transaction")
+	}
+	if _, err := repos.AccessTokens.GetById("token"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the token to be deleted in redis, got %v", err)
+	}
+}
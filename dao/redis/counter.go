@@ -0,0 +1,39 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Counter keep each counter in a key which expire at the end of its window
+type Counter struct {
+	client *goredis.Client
+	prefix string
+}
+
+func NewCounterDao(client *goredis.Client, prefix string) *Counter {
+	return &Counter{client: client, prefix: prefix}
+}
+
+func (cd *Counter) Incr(key string, window time.Duration) (int64, error) {
+	var incr *goredis.IntCmd
+	_, err := cd.client.TxPipelined(context.Background(), func(pipe goredis.Pipeliner) error {
+		ctx := context.Background()
+		k := cd.prefix + "counter:" + key
+		// the first increment of the window set the expiration
+		pipe.SetNX(ctx, k, 0, window)
+		incr = pipe.Incr(ctx, k)
+		return nil
+	})
+	if err != nil {
+		return 0, wrap(err)
+	}
+	return incr.Val(), nil
+}
+
+// DeleteExpired has nothing to do, redis remove the expired keys
+func (cd *Counter) DeleteExpired(now time.Time) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,29 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterIncr(t *testing.T) {
+	mr, client := newTestClient(t)
+	counters := NewCounterDao(client, defaultPrefix)
+
+	for i := int64(1); i <= 3; i++ {
+		if n, err := counters.Incr("login:alice", 10*time.Second); err != nil || n != i {
+			t.Fatalf("expected %d, got %d: %v", i, n, err)
+		}
+	}
+	if n, _ := counters.Incr("login:bob", 10*time.Second); n != 1 {
+		t.Fatalf("expected the counters to be separated, got %d", n)
+	}
+
+	// the window is not extended by the increments
+	mr.FastForward(11 * time.Second)
+	if n, err := counters.Incr("login:alice", 10*time.Second); err != nil || n != 1 {
+		t.Fatalf("expected a new window, got %d: %v", n, err)
+	}
+	if ttl := mr.TTL(defaultPrefix + "counter:login:alice"); ttl <= 0 || ttl > 10*time.Second {
+		t.Fatalf("unexpected ttl %s", ttl)
+	}
+}
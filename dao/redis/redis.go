@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const defaultPrefix = "babakoto:"
+
+// Config of a server speaking the redis protocol (redis, valkey, keydb...)
+type Config struct {
+	// host:port
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	Db       int    `json:"db"`
+	// prefix of the keys, to share the server. Default to "babakoto:".
+	Prefix string `json:"prefix"`
+}
+
+func (c Config) prefix() string {
+	if c.Prefix == "" {
+		return defaultPrefix
+	}
+	return c.Prefix
+}
+
+// Open connect to the server and check it answer
+func Open(c Config) (*goredis.Client, error) {
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     c.Addr,
+		Password: c.Password,
+		DB:       c.Db,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("unable to reach redis at %s: %s", c.Addr, err.Error())
+	}
+	return client, nil
+}
+
+// NewRepositories return r with its access tokens and its counters kept in
+// the redis server of client. The signup verifications are left in r on
+// purpose, see config.StoreConfig.
+func NewRepositories(r dao.Repositories, client *goredis.Client, c Config) dao.Repositories {
+	return r.WithTokens(NewAccessTokenDao(client, c.prefix()), NewCounterDao(client, c.prefix()))
+}
+
+// wrap give the kind of the error like the gorm daos, the errors which are
+// not a reply of the server are connection errors
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	var replyErr goredis.Error
+	switch {
+	case errors.Is(err, goredis.Nil):
+		return &dao.Error{Kind: dao.ErrNotFound, Err: err}
+	case errors.As(err, &replyErr):
+		return err
+	}
+	return &dao.Error{Kind: dao.ErrUnavailable, Err: err}
+}
@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jeremyletang/babakoto_api/dao"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// newTestClient return a client of an in-process redis, closed with the test
+func newTestClient(t *testing.T) (*miniredis.Miniredis, *goredis.Client) {
+	mr := miniredis.RunT(t)
+	client, err := Open(Config{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func TestOpen(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+	if _, err := Open(Config{Addr: mr.Addr()}); err == nil {
+		t.Fatalf("expected an error without password")
+	}
+	client, err := Open(Config{Addr: mr.Addr(), Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestUnavailable(t *testing.T) {
+	mr, client := newTestClient(t)
+	tokens := NewAccessTokenDao(client, defaultPrefix)
+	mr.Close()
+	if _, err := tokens.GetById("token"); !errors.Is(err, dao.ErrUnavailable) {
+		t.Fatalf("expected %v, got %v", dao.ErrUnavailable, err)
+	}
+}
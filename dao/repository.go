@@ -0,0 +1,211 @@
+package dao
+
+import (
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jeremyletang/babakoto_api/pii"
+	"github.com/jinzhu/gorm"
+)
+
+// the getters and List of the users can read from a replica, the other
+// reads need the latest data
+type UserRepository interface {
+	GetById(id string) (domain.User, error)
+	GetByEmailOrUsername(str string) (domain.User, error)
+	GetByMail(email string) (domain.User, error)
+	GetByUsername(username string) (domain.User, error)
+	Create(u domain.User) error
+	// Update save u if its version is still the stored one and return it
+	// with the next version, ErrStale otherwise
+	Update(u domain.User) (domain.User, error)
+	// the getters ignore the deleted users, Delete only mark the user as
+	// deleted and Restore unmark it
+	Delete(id string) error
+	Restore(id string) error
+	// Purge remove the user row, deleted or not
+	Purge(id string) error
+	// GetDeletedBefore return at most limit users deleted before t, oldest first
+	GetDeletedBefore(t time.Time, limit int) ([]domain.User, error)
+	// the email and username of the deleted users stay reserved until purge
+	IsEmailUsed(email string) (bool, error)
+	IsUsernameUsed(username string) (bool, error)
+	// List return a page of the users which are not deleted and the cursor
+	// of the next page, empty on the last page
+	List(page pagination.Page) ([]domain.User, string, error)
+}
+
+// only List read from a replica, a revoked token must stop working at once
+type AccessTokenRepository interface {
+	GetById(id string) (domain.AccessToken, error)
+	GetByUserId(userId string) (domain.AccessToken, error)
+	Create(at domain.AccessToken) error
+	Delete(id string) error
+	DeleteByUserId(userId string) error
+	// DeleteExpired remove the tokens expired at now and return how many
+	DeleteExpired(now time.Time) (int64, error)
+	List(page pagination.Page) ([]domain.AccessToken, string, error)
+}
+
+type SignupVerificationRepository interface {
+	GetById(id string) (domain.UserSignupVerification, error)
+	GetByUserId(userId string) (domain.UserSignupVerification, error)
+	// GetExpired return at most limit verifications of signup expired at now,
+	// oldest first. The email changes are not returned.
+	GetExpired(now time.Time, limit int) ([]domain.UserSignupVerification, error)
+	Create(usv domain.UserSignupVerification) error
+	Delete(id string) error
+	DeleteByUserId(userId string) error
+}
+
+type ExternalIdentityRepository interface {
+	GetByIssuerAndSubject(issuer, subject string) (domain.ExternalIdentity, error)
+	Create(ei domain.ExternalIdentity) error
+	DeleteByUserId(userId string) error
+}
+
+// LeaseRepository hold named locks which expire, the holder must renew
+// the lease before its expiration to keep it
+type LeaseRepository interface {
+	// Acquire take or renew the lease for ttl, return false if another
+	// holder has it
+	Acquire(name, holder string, ttl time.Duration) (bool, error)
+	Release(name, holder string) error
+}
+
+// AuditEventRepository is append only, the events are never updated
+type AuditEventRepository interface {
+	Create(e domain.AuditEvent) error
+	List(page pagination.Page) ([]domain.AuditEvent, string, error)
+}
+
+// CounterRepository count the events of a key over fixed windows, for the
+// rate limits
+type CounterRepository interface {
+	// Incr add one to the counter of key and return its value, the counter
+	// restart from zero window after its first increment
+	Incr(key string, window time.Duration) (int64, error)
+	// DeleteExpired remove the counters whose window ended at now and return
+	// how many
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+type UserPermissionRepository interface {
+	GetByUserId(userId string) ([]domain.UserPermission, error)
+	GetByUserIdAndPermission(userId, permission string) (domain.UserPermission, error)
+	Create(up domain.UserPermission) error
+	Delete(id string) error
+	DeleteByUserId(userId string) error
+}
+
+// Repositories group the repositories of a storage, the handlers and the
+// services only depend on it so the storage can be swapped (gorm, memory)
+type Repositories struct {
+	Users               UserRepository
+	AccessTokens        AccessTokenRepository
+	SignupVerifications SignupVerificationRepository
+	ExternalIdentities  ExternalIdentityRepository
+	UserPermissions     UserPermissionRepository
+	Leases              LeaseRepository
+	AuditEvents         AuditEventRepository
+	Counters            CounterRepository
+	// RunInTx is set by the storage, use WithTx
+	RunInTx TxFunc
+	// OpenSession is set by the storage, use Session
+	OpenSession func() Repositories
+}
+
+// TxFunc run fn with repositories bound to a transaction, the transaction is
+// committed if fn return nil and rolled back otherwise
+type TxFunc func(fn func(tx Repositories) error) error
+
+// WithTx run fn in a transaction, every write done through tx is rolled back
+// if fn return an error. Calling WithTx on tx join the current transaction.
+func (r Repositories) WithTx(fn func(tx Repositories) error) error {
+	if r.RunInTx == nil {
+		return fn(r)
+	}
+	return r.RunInTx(fn)
+}
+
+// Session return repositories which read their own writes: once they wrote,
+// their reads no longer go to a replica. Use one in the handlers which read
+// after writing.
+func (r Repositories) Session() Repositories {
+	if r.OpenSession == nil {
+		return r
+	}
+	return r.OpenSession()
+}
+
+// WithTokens return r with the access tokens and the counters kept in
+// another store, in the transactions and the sessions too. Their writes are
+// not rolled back with the transactions.
+func (r Repositories) WithTokens(tokens AccessTokenRepository, counters CounterRepository) Repositories {
+	r.AccessTokens = tokens
+	r.Counters = counters
+	if runInTx := r.RunInTx; runInTx != nil {
+		r.RunInTx = func(fn func(tx Repositories) error) error {
+			return runInTx(func(tx Repositories) error {
+				return fn(tx.WithTokens(tokens, counters))
+			})
+		}
+	}
+	if openSession := r.OpenSession; openSession != nil {
+		r.OpenSession = func() Repositories {
+			return openSession().WithTokens(tokens, counters)
+		}
+	}
+	return r
+}
+
+// NewGormRepositories return the repositories backed by the gorm daos. The
+// reads which can lag behind the writes go to the replicas if not nil, the
+// personal data is encrypted with cipher if not nil.
+func NewGormRepositories(db *gorm.DB, replicas *database.Replicas, cipher *pii.Cipher) Repositories {
+	registerSession(db)
+	return openGormRepositories(db, replicas, cipher, nil, newPins())
+}
+
+func openGormRepositories(db *gorm.DB, replicas *database.Replicas, cipher *pii.Cipher, s *session, p *pins) Repositories {
+	if s != nil {
+		db = db.Set(sessionKey, s)
+	}
+	repos := newGormRepositories(db, router{db, replicas, s, p}, cipher)
+	repos.RunInTx = func(fn func(tx Repositories) error) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			// everything is read from the transaction
+			txRepos := newGormRepositories(tx, router{primary: tx, pins: p}, cipher)
+			// gorm cannot nest the transactions, join this one
+			txRepos.RunInTx = func(fn func(tx Repositories) error) error {
+				return fn(txRepos)
+			}
+			return fn(txRepos)
+		})
+	}
+	repos.OpenSession = func() Repositories {
+		return openGormRepositories(db, replicas, cipher, &session{}, p)
+	}
+	return repos
+}
+
+func newGormRepositories(db *gorm.DB, route router, cipher *pii.Cipher) Repositories {
+	users := NewUserDao(db, cipher)
+	users.route = route
+	accessTokens := NewAccessTokenDao(db)
+	accessTokens.route = route
+	auditEvents := NewAuditEventDao(db)
+	auditEvents.route = route
+	return Repositories{
+		Users:               users,
+		AccessTokens:        accessTokens,
+		SignupVerifications: NewUserSignupVerificationDao(db),
+		ExternalIdentities:  NewExternalIdentityDao(db, cipher),
+		UserPermissions:     NewUserPermissionDao(db),
+		Leases:              NewLeaseDao(db),
+		AuditEvents:         auditEvents,
+		Counters:            NewCounterDao(db),
+	}
+}
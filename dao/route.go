@@ -0,0 +1,115 @@
+package dao
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jinzhu/gorm"
+)
+
+// session remember that the repositories of a request wrote, their next reads
+// go to the primary to see the writes
+type session struct {
+	wrote int32
+}
+
+const sessionKey = "dao:session"
+
+func (s *session) hasWritten() bool {
+	return s != nil && atomic.LoadInt32(&s.wrote) == 1
+}
+
+// markWrote is called by gorm after the writes done with a session
+func markWrote(scope *gorm.Scope) {
+	if s, ok := scope.Get(sessionKey); ok {
+		atomic.StoreInt32(&s.(*session).wrote, 1)
+	}
+}
+
+func registerSession(db *gorm.DB) {
+	callback := db.Callback()
+	if callback.Create().Get(sessionKey) != nil {
+		return
+	}
+	callback.Create().After("gorm:create").Register(sessionKey, markWrote)
+	callback.Update().After("gorm:update").Register(sessionKey, markWrote)
+	callback.Delete().After("gorm:delete").Register(sessionKey, markWrote)
+}
+
+// a user written by the process is read from the primary for this long,
+// longer than the replication lag is expected to be
+const pinTtl = 10 * time.Second
+
+// pins remember the users written by the process, so their next requests
+// see the write even if they do not share a session with it. The other
+// processes of the api still read them from the replicas.
+type pins struct {
+	mutex sync.Mutex
+	until map[string]time.Time
+}
+
+func newPins() *pins {
+	return &pins{until: map[string]time.Time{}}
+}
+
+func (p *pins) pin(id string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for pinned, until := range p.until {
+		if now.After(until) {
+			delete(p.until, pinned)
+		}
+	}
+	p.until[id] = now.Add(pinTtl)
+}
+
+func (p *pins) pinned(id string) bool {
+	if p == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	until, ok := p.until[id]
+	return ok && time.Now().Before(until)
+}
+
+// errPinned make read retry on the primary
+var errPinned = errors.New("pinned to the primary")
+
+// router send the reads which can lag behind the writes to a replica
+type router struct {
+	primary  *gorm.DB
+	replicas *database.Replicas
+	session  *session
+	pins     *pins
+}
+
+// read run query on a replica unless the session wrote. The primary is used
+// if no replica is up, if the replica failed, if it missed the row which
+// may not be replicated yet or if the row is pinned.
+func (r router) read(query func(db *gorm.DB) error) error {
+	if r.replicas == nil || r.session.hasWritten() {
+		return query(r.primary)
+	}
+	replica := r.replicas.Next()
+	if replica == nil {
+		return query(r.primary)
+	}
+	err := query(replica)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(wrap(err), ErrUnavailable) {
+		log.Warnf("[dao.router.read] replica failed, reading from the primary: %s", err.Error())
+		r.replicas.Failed(replica)
+	}
+	return query(r.primary)
+}
@@ -0,0 +1,97 @@
+package dao
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jinzhu/gorm"
+)
+
+func openTestDb(t *testing.T, c database.Config) *gorm.DB {
+	db, err := database.Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestReplicated return repositories on a primary and a replica which
+// never catch up, and the replica db to copy rows into
+func newTestReplicated(t *testing.T) (Repositories, *gorm.DB) {
+	dir := t.TempDir()
+	primary := openTestDb(t, database.Config{Driver: database.Sqlite3, Path: dir + "/primary.db"})
+	// a sqlite replica is the database of its path
+	c := database.Config{Driver: database.Sqlite3, Path: dir + "/replica.db", Replicas: []database.Replica{{Host: "replica"}}}
+	openTestDb(t, c).Close()
+	replicas := database.OpenReplicas(c)
+	if replicas == nil {
+		t.Fatal("replica not opened")
+	}
+	t.Cleanup(replicas.Close)
+	var replica *gorm.DB
+	replicas.Each(func(db *gorm.DB, label string) { replica = db })
+	return NewGormRepositories(primary, replicas, nil), replica
+}
+
+// replicate create u on both databases, as if replicated
+func replicate(t *testing.T, repos Repositories, replica *gorm.DB, u domain.User) {
+	if err := repos.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewUserDao(replica, nil).Create(u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinnedUser(t *testing.T) {
+	repos, replica := newTestReplicated(t)
+	now := time.Now()
+	for _, id := range []string{"alice", "bob"} {
+		replicate(t, repos, replica, domain.User{Id: id, Username: id, Email: id + "@example.com",
+			Version: 1, CreatedAt: now, UpdatedAt: now})
+	}
+
+	// bob is changed by another process, his reads still go to the replica
+	if err := repos.Users.(*User).db.Exec("UPDATE users SET username = 'bob2', version = 2 WHERE id = 'bob'").Error; err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repos.Users.GetById("bob"); u.Username != "bob" {
+		t.Fatalf("expected bob to be read from the replica, got %+v", u)
+	}
+
+	// the next requests of alice see her update
+	u, _ := repos.Users.GetById("alice")
+	u.Username = "alice2"
+	if _, err := repos.Users.Update(u); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repos.Users.GetById("alice"); u.Username != "alice2" || u.Version != 2 {
+		t.Fatalf("expected alice to be read from the primary, got %+v", u)
+	}
+	if u, _ := repos.Users.GetByEmailOrUsername("alice@example.com"); u.Version != 2 {
+		t.Fatalf("expected alice to be read from the primary, got %+v", u)
+	}
+	// the transactions and the sessions share the pins
+	err := repos.WithTx(func(tx Repositories) error {
+		return tx.Users.Delete("bob")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Session().Users.GetById("bob"); err == nil {
+		t.Fatalf("expected bob to be deleted")
+	}
+
+	// until the replicas caught up
+	repos.Users.(*User).route.pins.until["alice"] = now
+	if u, _ := repos.Users.GetById("alice"); u.Username != "alice" {
+		t.Fatalf("expected alice to be read from the replica once unpinned, got %+v", u)
+	}
+}
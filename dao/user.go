@@ -1,47 +1,284 @@
 package dao
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pagination"
+	"github.com/jeremyletang/babakoto_api/pii"
 	"github.com/jinzhu/gorm"
 )
 
+// userRow is the stored user, the email is encrypted and searched with its
+// blind index. The index is NULL for the users stored before the encryption
+// was enabled, until they are re-encrypted.
+type userRow struct {
+	domain.User
+	EmailIndex *string
+}
+
+func (userRow) TableName() string {
+	return "users"
+}
+
 type User struct {
-	db *gorm.DB
+	db     *gorm.DB
+	route  router
+	cipher *pii.Cipher
+}
+
+// NewUserDao return the users dao, the emails are stored in clear if cipher
+// is nil
+func NewUserDao(db *gorm.DB, cipher *pii.Cipher) *User {
+	return &User{db: db, route: router{primary: db}, cipher: cipher}
+}
+
+func (ud *User) toRow(u domain.User) (userRow, error) {
+	row := userRow{User: u}
+	if ud.cipher == nil {
+		return row, nil
+	}
+	var err error
+	if row.Email, err = ud.cipher.Encrypt("users.email", u.Email); err != nil {
+		return row, err
+	}
+	index := ud.cipher.Index(u.Email)
+	row.EmailIndex = &index
+	return row, nil
+}
+
+func (ud *User) fromRow(row userRow) (domain.User, error) {
+	u := row.User
+	var err error
+	if u.Email, err = ud.cipher.Decrypt("users.email", row.Email); err != nil {
+		return u, fmt.Errorf("unable to decrypt email of user [id=%s]: %s", u.Id, err.Error())
+	}
+	return u, nil
+}
+
+func (ud *User) fromRows(rows []userRow) ([]domain.User, error) {
+	us := []domain.User{}
+	for _, row := range rows {
+		u, err := ud.fromRow(row)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, nil
+}
+
+// emailCondition match the email by its index, or in clear for the users
+// not re-encrypted yet
+func (ud *User) emailCondition(email string) (string, []interface{}) {
+	if ud.cipher == nil {
+		return "users.email = ?", []interface{}{email}
+	}
+	return "(users.email_index = ? OR (users.email_index IS NULL AND users.email = ?))",
+		[]interface{}{ud.cipher.Index(email), email}
 }
 
-func NewUserDao(db *gorm.DB) *User {
-	return &User{db: db}
+func (ud *User) get(query string, args ...interface{}) (domain.User, error) {
+	row := userRow{}
+	err := ud.route.read(func(db *gorm.DB) error {
+		if err := db.Where(query, args...).First(&row).Error; err != nil {
+			return err
+		}
+		// the replica may not have the last write of the user yet
+		if db != ud.route.primary && ud.route.pins.pinned(row.Id) {
+			return errPinned
+		}
+		return nil
+	})
+	if err != nil {
+		return domain.User{}, wrap(err)
+	}
+	return ud.fromRow(row)
 }
 
 func (ud *User) GetById(id string) (domain.User, error) {
-	u := domain.User{Id: id}
-	err := ud.db.First(&u).Error
-	return u, err
+	return ud.get("users.id = ?", id)
 }
 
 func (ud *User) GetByEmailOrUsername(str string) (domain.User, error) {
-	u := domain.User{}
-	err := ud.db.Where("users.email = ? OR users.username = ?", str, str).
-		First(&u).Error
-	return u, err
+	cond, args := ud.emailCondition(str)
+	return ud.get(cond+" OR users.username = ?", append(args, str)...)
 }
 
 func (ud *User) GetByMail(email string) (domain.User, error) {
-	u := domain.User{Email: email}
-	err := ud.db.First(&u).Error
-	return u, err
+	cond, args := ud.emailCondition(email)
+	return ud.get(cond, args...)
 }
 
 func (ud *User) GetByUsername(username string) (domain.User, error) {
-	u := domain.User{Username: username}
-	err := ud.db.First(&u).Error
-	return u, err
+	return ud.get("users.username = ?", username)
 }
 
 func (ud *User) Create(u domain.User) error {
-	return ud.db.Create(&u).Error
+	row, err := ud.toRow(u)
+	if err != nil {
+		return err
+	}
+	return wrap(ud.db.Create(&row).Error)
+}
+
+func (ud *User) Update(u domain.User) (domain.User, error) {
+	row, err := ud.toRow(u)
+	if err != nil {
+		return u, err
+	}
+	// UpdateColumns so gorm does not touch updated_at
+	res := ud.db.Model(&userRow{}).
+		Where("users.id = ? AND users.version = ?", u.Id, u.Version).
+		UpdateColumns(map[string]interface{}{
+			"username":    row.Username,
+			"email":       row.Email,
+			"email_index": row.EmailIndex,
+			"password":    row.Password,
+			"updated_at":  row.UpdatedAt,
+			"version":     gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return u, wrap(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		// tell a stale version from a missing user
+		if _, err := ud.GetById(u.Id); err != nil {
+			return u, err
+		}
+		return u, &Error{ErrStale, fmt.Errorf("user [id=%s] is not at version %d", u.Id, u.Version)}
+	}
+	ud.route.pins.pin(u.Id)
+	u.Version++
+	return u, nil
+}
+
+func (ud *User) Delete(id string) error {
+	// not the gorm soft delete, the version must change too
+	err := ud.db.Model(&userRow{}).Where("users.id = ?", id).
+		UpdateColumns(map[string]interface{}{
+			"deleted_at": gorm.NowFunc(),
+			"version":    gorm.Expr("version + 1"),
+		}).Error
+	if err != nil {
+		return wrap(err)
+	}
+	ud.route.pins.pin(id)
+	return nil
+}
+
+func (ud *User) Restore(id string) error {
+	res := ud.db.Unscoped().Model(&userRow{}).
+		Where("users.id = ? AND users.deleted_at IS NOT NULL", id).
+		UpdateColumns(map[string]interface{}{
+			"deleted_at": nil,
+			"version":    gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return wrap(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return &Error{ErrNotFound, gorm.ErrRecordNotFound}
+	}
+	ud.route.pins.pin(id)
+	return nil
+}
+
+func (ud *User) Purge(id string) error {
+	return wrap(ud.db.Unscoped().Where("users.id = ?", id).Delete(&userRow{}).Error)
+}
+
+func (ud *User) GetDeletedBefore(t time.Time, limit int) ([]domain.User, error) {
+	rows := []userRow{}
+	err := ud.db.Unscoped().Where("users.deleted_at < ?", t.UTC()).
+		Order("users.deleted_at").Limit(limit).Find(&rows).Error
+	if err != nil {
+		return nil, wrap(err)
+	}
+	return ud.fromRows(rows)
+}
+
+func (ud *User) IsEmailUsed(email string) (bool, error) {
+	var count int
+	cond, args := ud.emailCondition(email)
+	err := ud.db.Unscoped().Model(&userRow{}).Where(cond, args...).Count(&count).Error
+	return count > 0, wrap(err)
+}
+
+func (ud *User) IsUsernameUsed(username string) (bool, error) {
+	var count int
+	err := ud.db.Unscoped().Model(&userRow{}).Where("users.username = ?", username).Count(&count).Error
+	return count > 0, wrap(err)
+}
+
+func (ud *User) List(page pagination.Page) ([]domain.User, string, error) {
+	if ud.cipher != nil {
+		// the email is encrypted, filter on its index. The users not
+		// re-encrypted yet are not found.
+		conditions := []pagination.Condition{}
+		for _, c := range page.Conditions {
+			if c.Column == "users.email" {
+				c.Column, c.Value = "users.email_index", ud.cipher.Index(fmt.Sprint(c.Value))
+			}
+			conditions = append(conditions, c)
+		}
+		page.Conditions = conditions
+	}
+	rows := []userRow{}
+	err := ud.route.read(func(db *gorm.DB) error {
+		return page.Apply(db).Find(&rows).Error
+	})
+	if err != nil {
+		return nil, "", wrap(err)
+	}
+	us, err := ud.fromRows(rows)
+	if err != nil {
+		return nil, "", err
+	}
+	n, next := page.Next(len(us), func(i int, column string) interface{} {
+		return UserColumn(us[i], column)
+	})
+	return us[:n], next, nil
 }
 
-func (ud *User) Update(u domain.User) error {
-	return ud.db.Save(&u).Error
+// Reencrypt encrypt again the emails which are in clear or use an old key,
+// deleted users included, by batches. It return how many users were updated.
+func (ud *User) Reencrypt(batch int) (int64, error) {
+	var updated int64
+	last := ""
+	for {
+		rows := []userRow{}
+		err := ud.db.Unscoped().Where("users.id > ?", last).Order("users.id").Limit(batch).Find(&rows).Error
+		if err != nil {
+			return updated, wrap(err)
+		}
+		for _, row := range rows {
+			if !ud.cipher.Stale(row.Email) && row.EmailIndex != nil {
+				continue
+			}
+			u, err := ud.fromRow(row)
+			if err != nil {
+				return updated, err
+			}
+			newRow, err := ud.toRow(u)
+			if err != nil {
+				return updated, err
+			}
+			// the version is kept, the user did not change
+			err = ud.db.Unscoped().Model(&userRow{}).Where("users.id = ?", u.Id).
+				UpdateColumns(map[string]interface{}{
+					"email":       newRow.Email,
+					"email_index": newRow.EmailIndex,
+				}).Error
+			if err != nil {
+				return updated, wrap(err)
+			}
+			updated++
+		}
+		if len(rows) < batch {
+			return updated, nil
+		}
+		last = rows[len(rows)-1].Id
+	}
 }
@@ -0,0 +1,39 @@
+package dao
+
+import (
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jinzhu/gorm"
+)
+
+type UserPermission struct {
+	db *gorm.DB
+}
+
+func NewUserPermissionDao(db *gorm.DB) *UserPermission {
+	return &UserPermission{db: db}
+}
+
+func (upd *UserPermission) GetByUserId(userId string) ([]domain.UserPermission, error) {
+	ups := []domain.UserPermission{}
+	err := upd.db.Where("user_permissions.user_id = ?", userId).Find(&ups).Error
+	return ups, wrap(err)
+}
+
+func (upd *UserPermission) GetByUserIdAndPermission(userId, permission string) (domain.UserPermission, error) {
+	up := domain.UserPermission{}
+	err := upd.db.Where("user_permissions.user_id = ? AND user_permissions.permission = ?", userId, permission).
+		First(&up).Error
+	return up, wrap(err)
+}
+
+func (upd *UserPermission) Create(up domain.UserPermission) error {
+	return wrap(upd.db.Create(&up).Error)
+}
+
+func (upd *UserPermission) Delete(id string) error {
+	return wrap(upd.db.Where("user_permissions.id = ?", id).Delete(&domain.UserPermission{}).Error)
+}
+
+func (upd *UserPermission) DeleteByUserId(userId string) error {
+	return wrap(upd.db.Where("user_permissions.user_id = ?", userId).Delete(&domain.UserPermission{}).Error)
+}
@@ -1,6 +1,8 @@
 package dao
 
 import (
+	"time"
+
 	"github.com/jeremyletang/babakoto_api/domain"
 	"github.com/jinzhu/gorm"
 )
@@ -14,21 +16,33 @@ func NewUserSignupVerificationDao(db *gorm.DB) *UserSignupVerification {
 }
 
 func (usvd *UserSignupVerification) GetById(id string) (domain.UserSignupVerification, error) {
-	usv := domain.UserSignupVerification{Id: id}
-	err := usvd.db.First(&usv).Error
-	return usv, err
+	usv := domain.UserSignupVerification{}
+	err := usvd.db.Where("user_signup_verifications.id = ?", id).First(&usv).Error
+	return usv, wrap(err)
 }
 
 func (usvd *UserSignupVerification) GetByUserId(userId string) (domain.UserSignupVerification, error) {
-	usv := domain.UserSignupVerification{UserId: userId}
-	err := usvd.db.First(&usv).Error
-	return usv, err
+	usv := domain.UserSignupVerification{}
+	err := usvd.db.Where("user_signup_verifications.user_id = ?", userId).First(&usv).Error
+	return usv, wrap(err)
+}
+
+func (usvd *UserSignupVerification) GetExpired(now time.Time, limit int) ([]domain.UserSignupVerification, error) {
+	usvs := []domain.UserSignupVerification{}
+	err := usvd.db.Where("user_signup_verifications.expires_at < ? AND user_signup_verifications.email_change = ?",
+		now.UTC(), false).
+		Order("user_signup_verifications.expires_at").Limit(limit).Find(&usvs).Error
+	return usvs, wrap(err)
 }
 
 func (usvd *UserSignupVerification) Create(at domain.UserSignupVerification) error {
-	return usvd.db.Create(&at).Error
+	return wrap(usvd.db.Create(&at).Error)
 }
 
 func (usvd *UserSignupVerification) Delete(id string) error {
-	return usvd.db.Delete(&domain.UserSignupVerification{Id: id}).Error
+	return wrap(usvd.db.Where("user_signup_verifications.id = ?", id).Delete(&domain.UserSignupVerification{}).Error)
+}
+
+func (usvd *UserSignupVerification) DeleteByUserId(userId string) error {
+	return wrap(usvd.db.Where("user_signup_verifications.user_id = ?", userId).Delete(&domain.UserSignupVerification{}).Error)
 }
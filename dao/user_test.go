@@ -0,0 +1,97 @@
+package dao
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/pii"
+)
+
+func newTestCipher(t *testing.T, current string) *pii.Cipher {
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), 32)))
+	}
+	c, err := pii.Load(pii.Config{
+		CurrentKey: current,
+		Keys:       map[string]string{"k1": key(1), "k2": key(2)},
+		IndexKey:   key(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// storedEmail return the email column of the user as stored
+func storedEmail(t *testing.T, ud *User, id string) string {
+	row := userRow{}
+	if err := ud.db.Unscoped().Where("users.id = ?", id).First(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+	return row.Email
+}
+
+func TestEncryptedEmail(t *testing.T) {
+	db := openTestDb(t, database.Config{Driver: database.Sqlite3, Path: t.TempDir() + "/babakoto.db"})
+	users := NewUserDao(db, newTestCipher(t, "k1"))
+	now := time.Now()
+	if err := users.Create(domain.User{Id: "alice", Username: "alice", Email: "alice@example.com", Version: 1, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if email := storedEmail(t, users, "alice"); pii.KeyId(email) != "k1" {
+		t.Fatalf("expected the email to be encrypted, got %s", email)
+	}
+
+	// found by the blind index
+	for _, find := range []func(string) (domain.User, error){users.GetByEmailOrUsername, users.GetByMail} {
+		u, err := find("alice@example.com")
+		if err != nil || u.Id != "alice" || u.Email != "alice@example.com" {
+			t.Fatalf("expected alice with her email in clear: %+v %v", u, err)
+		}
+	}
+	if used, err := users.IsEmailUsed("alice@example.com"); !used || err != nil {
+		t.Fatalf("expected the email to be used: %v", err)
+	}
+	if _, err := users.GetByMail("bob@example.com"); err == nil {
+		t.Fatalf("expected bob to be unknown")
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	db := openTestDb(t, database.Config{Driver: database.Sqlite3, Path: t.TempDir() + "/babakoto.db"})
+	now := time.Now()
+	// bob was created before the encryption was enabled
+	if err := NewUserDao(db, nil).Create(domain.User{Id: "bob", Username: "bob", Email: "bob@example.com", Version: 1, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	old := NewUserDao(db, newTestCipher(t, "k1"))
+	if err := old.Create(domain.User{Id: "alice", Username: "alice", Email: "alice@example.com", Version: 1, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewUserDao(db, newTestCipher(t, "k2"))
+	// still readable before being encrypted again
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		if _, err := users.GetByEmailOrUsername(email); err != nil {
+			t.Fatalf("expected %s to be found: %s", email, err)
+		}
+	}
+	if n, err := users.Reencrypt(1); n != 2 || err != nil {
+		t.Fatalf("expected 2 users encrypted again, got %d: %v", n, err)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if email := storedEmail(t, users, id); pii.KeyId(email) != "k2" {
+			t.Fatalf("expected %s to use the current key, got %s", id, email)
+		}
+		if u, _ := users.GetById(id); u.Email != id+"@example.com" || u.Version != 1 {
+			t.Fatalf("unexpected user %+v", u)
+		}
+	}
+	if n, err := users.Reencrypt(10); n != 0 || err != nil {
+		t.Fatalf("expected nothing left to encrypt, got %d: %v", n, err)
+	}
+}
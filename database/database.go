@@ -0,0 +1,186 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// the gorm dialect names, also the folders of the migrations
+const (
+	Mysql    = "mysql"
+	Postgres = "postgres"
+	Sqlite3  = "sqlite3"
+)
+
+var defaultPorts = map[string]string{
+	Mysql:    "3306",
+	Postgres: "5432",
+}
+
+type Config struct {
+	// mysql (default), postgres or sqlite3
+	Driver   string `json:"driver"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Name     string `json:"name"`
+	// postgres sslmode (disable, require, verify-full ...), default to require
+	SslMode string `json:"ssl_mode"`
+	// database file for sqlite3, ":memory:" for a throwaway database
+	Path string `json:"path"`
+	// connection pool, 0 keep the driver defaults. The lifetimes are in
+	// seconds.
+	MaxOpenConns    int `json:"max_open_conns"`
+	MaxIdleConns    int `json:"max_idle_conns"`
+	ConnMaxLifetime int `json:"conn_max_lifetime"`
+	ConnMaxIdleTime int `json:"conn_max_idle_time"`
+	// seconds to retry the connection at startup, the database may start
+	// after the api. Default to 30.
+	StartupTimeout int `json:"startup_timeout"`
+	// read only copies of the database used by the reads which can lag
+	// behind the writes, mysql and postgres only
+	Replicas []Replica `json:"replicas"`
+}
+
+// Replica use the user, password and name of the primary
+type Replica struct {
+	Host string `json:"host"`
+	// default to the port of the primary
+	Port string `json:"port"`
+}
+
+const defaultStartupTimeout = 30
+
+// the wait between two connection attempts double up to the max
+const (
+	firstRetryDelay = 250 * time.Millisecond
+	maxRetryDelay   = 5 * time.Second
+)
+
+// WithDefaults fill the driver and the port
+func (c Config) WithDefaults() Config {
+	if c.Driver == "" {
+		c.Driver = Mysql
+	}
+	if c.Port == "" {
+		c.Port = defaultPorts[c.Driver]
+	}
+	if c.Driver == Postgres && c.SslMode == "" {
+		c.SslMode = "require"
+	}
+	if c.StartupTimeout == 0 {
+		c.StartupTimeout = defaultStartupTimeout
+	}
+	return c
+}
+
+// replica return the configuration of the i-th replica
+func (c Config) replica(i int) Config {
+	rc := c
+	rc.Host = c.Replicas[i].Host
+	if c.Replicas[i].Port != "" {
+		rc.Port = c.Replicas[i].Port
+	}
+	rc.Replicas = nil
+	return rc
+}
+
+// Dsn return the connection string for the driver
+func (c Config) Dsn() (string, error) {
+	switch c.Driver {
+	case Mysql:
+		// "root:root@tcp(192.168.99.100:3307)/babakoto?parseTime=True"
+		return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=True",
+			c.User, c.Password, c.Host, c.Port, c.Name), nil
+	case Postgres:
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.User, c.Password),
+			Host:     fmt.Sprintf("%s:%s", c.Host, c.Port),
+			Path:     "/" + c.Name,
+			RawQuery: url.Values{"sslmode": {c.SslMode}}.Encode(),
+		}
+		return u.String(), nil
+	case Sqlite3:
+		// sqlite ignore the foreign keys unless asked, and fail at once
+		// when another connection is writing
+		return fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", c.Path), nil
+	default:
+		return "", fmt.Errorf("unknown database driver %s", c.Driver)
+	}
+}
+
+func init() {
+	// the times set by gorm (deleted_at) are compared with the ones we set
+	gorm.NowFunc = func() time.Time {
+		return time.Now().UTC()
+	}
+}
+
+// Open connect to the database, the name of the gorm dialect is the driver.
+// The connection is retried with backoff for the startup timeout.
+func Open(c Config) (*gorm.DB, error) {
+	c = c.WithDefaults()
+	deadline := time.Now().Add(time.Duration(c.StartupTimeout) * time.Second)
+	delay := firstRetryDelay
+	for {
+		db, err := open(c)
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		log.Warnf("[database.Open] unable to connect to %s, retrying in %s: %s", c.Label(), delay, err.Error())
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// open make a single connection attempt
+func open(c Config) (*gorm.DB, error) {
+	dsn, err := c.Dsn()
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(c.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool := db.DB()
+	if c.MaxOpenConns > 0 {
+		pool.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		pool.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		pool.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetime) * time.Second)
+	}
+	if c.ConnMaxIdleTime > 0 {
+		pool.SetConnMaxIdleTime(time.Duration(c.ConnMaxIdleTime) * time.Second)
+	}
+	if c.Driver == Sqlite3 {
+		// a single writer, and every connection to :memory: is a new database
+		pool.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// Label identify the database in the metrics
+func (c Config) Label() string {
+	if c.Driver == Sqlite3 {
+		return c.Path
+	}
+	return c.Name
+}
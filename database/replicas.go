@@ -0,0 +1,93 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jinzhu/gorm"
+)
+
+// a failed replica is not used for this long
+const replicaCooldown = 30 * time.Second
+
+// Replicas spread the reads over the read replicas and skip the ones which
+// failed recently
+type Replicas struct {
+	dbs    []*gorm.DB
+	labels []string
+	mutex  sync.Mutex
+	next   int
+	down   map[*gorm.DB]time.Time
+}
+
+// OpenReplicas connect to the replicas of the configuration, nil if there is
+// none. A replica which cannot be reached at startup is left out, the
+// primary is enough to serve.
+func OpenReplicas(c Config) *Replicas {
+	c = c.WithDefaults()
+	if len(c.Replicas) == 0 {
+		return nil
+	}
+	r := &Replicas{down: map[*gorm.DB]time.Time{}}
+	for i := range c.Replicas {
+		rc := c.replica(i)
+		label := rc.Label() + "@" + rc.Host + ":" + rc.Port
+		db, err := open(rc)
+		if err != nil {
+			log.Errorf("[database.OpenReplicas] replica %s left out: %s", label, err.Error())
+			continue
+		}
+		r.dbs = append(r.dbs, db)
+		r.labels = append(r.labels, label)
+	}
+	if len(r.dbs) == 0 {
+		return nil
+	}
+	return r
+}
+
+// Next return the next replica up, nil if they are all down
+func (r *Replicas) Next() *gorm.DB {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for range r.dbs {
+		r.next = (r.next + 1) % len(r.dbs)
+		db := r.dbs[r.next]
+		if until, ok := r.down[db]; ok && now.Before(until) {
+			continue
+		}
+		delete(r.down, db)
+		return db
+	}
+	return nil
+}
+
+// Failed put db aside for a while
+func (r *Replicas) Failed(db *gorm.DB) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.down[db] = time.Now().Add(replicaCooldown)
+}
+
+// Each call f with the replicas and their label, to instrument them
+func (r *Replicas) Each(f func(db *gorm.DB, label string)) {
+	if r == nil {
+		return
+	}
+	for i, db := range r.dbs {
+		f(db, r.labels[i])
+	}
+}
+
+func (r *Replicas) Close() {
+	r.Each(func(db *gorm.DB, label string) {
+		if err := db.Close(); err != nil {
+			log.Errorf("[database.Replicas.Close] unable to close replica %s: %s", label, err.Error())
+		}
+	})
+}
@@ -9,6 +9,10 @@ type User struct {
 	Password  string    `json:"-"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// set when the user is deleted, gorm ignore these users unless unscoped
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// incremented by every write, an update must give the version it read
+	Version int `json:"version"`
 }
 
 type AccessToken struct {
@@ -16,6 +20,24 @@ type AccessToken struct {
 	UserId    string    `json:"user_id"`
 	Ttl       int       `json:"ttl"`
 	CreatedAt time.Time `json:"created_at"`
+	// CreatedAt + Ttl, stored so the expired tokens can be purged by a query
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewAccessToken return a token for the user valid for ttl seconds
+func NewAccessToken(id, userId string, ttl int, now time.Time) AccessToken {
+	return AccessToken{
+		Id:        id,
+		UserId:    userId,
+		Ttl:       ttl,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Second).UTC(),
+	}
+}
+
+// IsExpired return true if the token ttl is elapsed at now
+func (at AccessToken) IsExpired(now time.Time) bool {
+	return now.After(at.ExpiresAt)
 }
 
 type UserSignupVerification struct {
@@ -23,4 +45,82 @@ type UserSignupVerification struct {
 	UserId    string    `json:"user_id"`
 	Ttl       int       `json:"ttl"`
 	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// the verification of the new email of a verified user, the janitor
+	// only purge the users who never verified their account
+	EmailChange bool `json:"email_change"`
+}
+
+// NewUserSignupVerification return a verification for the user valid for
+// ttl seconds
+func NewUserSignupVerification(id, userId string, ttl int, now time.Time) UserSignupVerification {
+	return UserSignupVerification{
+		Id:        id,
+		UserId:    userId,
+		Ttl:       ttl,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Second).UTC(),
+	}
+}
+
+// IsExpired return true if the verification ttl is elapsed at now, the user
+// cannot validate his account anymore
+func (usv UserSignupVerification) IsExpired(now time.Time) bool {
+	return now.After(usv.ExpiresAt)
+}
+
+type ExternalIdentity struct {
+	Id        string    `json:"id"`
+	UserId    string    `json:"user_id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	// manage the other users and the api
+	PermissionAdmin = "admin"
+)
+
+type UserPermission struct {
+	Id         string    `json:"id"`
+	UserId     string    `json:"user_id"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// actions of the audit events
+const (
+	AuditSignup         = "signup"
+	AuditLogin          = "login"
+	AuditPasswordChange = "password_change"
+	AuditProfileUpdate  = "profile_update"
+	AuditAccountDelete  = "account_delete"
+	AuditUserRestore    = "user_restore"
+	AuditUserPurge      = "user_purge"
+)
+
+// AuditEvent record an action done on an account, it is kept after the user
+// is purged
+type AuditEvent struct {
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	// who did the action, empty when done by the api itself (e.g the janitor)
+	ActorId string `json:"actor_id"`
+	// the account the action was done on
+	UserId    string    `json:"user_id"`
+	RequestId string    `json:"request_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewAuditEvent(id, action, actorId, userId, requestId string, now time.Time) AuditEvent {
+	return AuditEvent{
+		Id:        id,
+		Action:    action,
+		ActorId:   actorId,
+		UserId:    userId,
+		RequestId: requestId,
+		CreatedAt: now.UTC(),
+	}
 }
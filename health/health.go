@@ -0,0 +1,126 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jeremyletang/babakoto_api/utils"
+	"github.com/jinzhu/gorm"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultTimeout = 2 * time.Second
+	statusUp       = "up"
+	statusDown     = "down"
+)
+
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Checker struct {
+	db *gorm.DB
+	// the store of the access tokens, nil when they are in the database
+	store   *goredis.Client
+	timeout time.Duration
+	// set to 1 once the server is shutting down
+	shuttingDown int32
+}
+
+// NewChecker check db and store on readiness, db is nil when the data is in
+// memory and store when the access tokens are in the database
+func NewChecker(db *gorm.DB, store *goredis.Client, timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Checker{db: db, store: store, timeout: timeout}
+}
+
+// ShuttingDown make the readiness fail so no new traffic is sent while the
+// in flight requests are drained
+func (c *Checker) ShuttingDown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+func (c *Checker) isShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+// Live only tell the process is able to answer
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(Check{Status: statusUp}))
+}
+
+// Ready check the dependencies needed to serve the api
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+	defer cancel()
+
+	checks := map[string]Check{}
+	ready := true
+
+	if c.isShuttingDown() {
+		checks["server"] = Check{Status: statusDown, Error: "shutting down"}
+		ready = false
+	} else {
+		checks["server"] = Check{Status: statusUp}
+	}
+
+	if c.db == nil {
+		// dev mode, the repositories are in memory
+		checks["database"] = Check{Status: statusUp}
+		checks["migrations"] = Check{Status: statusUp}
+	} else if err := c.db.DB().PingContext(ctx); err != nil {
+		checks["database"] = Check{Status: statusDown, Error: err.Error()}
+		// the migrations cannot be checked without the database
+		checks["migrations"] = Check{Status: statusDown, Error: "database unavailable"}
+		ready = false
+	} else {
+		checks["database"] = Check{Status: statusUp}
+		if err := c.checkMigrations(ctx); err != nil {
+			checks["migrations"] = Check{Status: statusDown, Error: err.Error()}
+			ready = false
+		} else {
+			checks["migrations"] = Check{Status: statusUp}
+		}
+	}
+
+	// without it no login nor authenticated request can succeed
+	if c.store != nil {
+		if err := c.store.Ping(ctx).Err(); err != nil {
+			checks["redis"] = Check{Status: statusDown, Error: err.Error()}
+			ready = false
+		} else {
+			checks["redis"] = Check{Status: statusUp}
+		}
+	}
+
+	if !ready {
+		log.Warnf("[health.Ready] not ready: %v", checks)
+		utils.WriteJsonResponse(w, http.StatusServiceUnavailable,
+			jsend.ErrorWithData("not ready", checks))
+		return
+	}
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.New(checks))
+}
+
+func (c *Checker) checkMigrations(ctx context.Context) error {
+	// gorm has no context, the check is abandoned on timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- migrations.Check(c.db)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
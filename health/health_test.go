@@ -0,0 +1,49 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func ready(c *Checker) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	c.Ready(w, httptest.NewRequest("GET", "/readyz", nil))
+	body := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	checks, _ := body["data"].(map[string]interface{})
+	return w.Code, checks
+}
+
+func TestReadyStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	defer store.Close()
+	c := NewChecker(nil, store, 0)
+
+	code, checks := ready(c)
+	if code != http.StatusOK || checks["redis"].(map[string]interface{})["status"] != statusUp {
+		t.Fatalf("expected ready, got %d: %v", code, checks)
+	}
+
+	mr.Close()
+	code, checks = ready(c)
+	if code != http.StatusServiceUnavailable || checks["redis"].(map[string]interface{})["status"] != statusDown {
+		t.Fatalf("expected not ready, got %d: %v", code, checks)
+	}
+}
+
+func TestReadyShuttingDown(t *testing.T) {
+	c := NewChecker(nil, nil, 0)
+	if code, checks := ready(c); code != http.StatusOK || checks["redis"] != nil {
+		t.Fatalf("expected ready without redis check, got %d: %v", code, checks)
+	}
+	c.ShuttingDown()
+	if code, _ := ready(c); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready, got %d", code)
+	}
+}
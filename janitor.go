@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/config"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/janitor"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jeremyletang/babakoto_api/pii"
+)
+
+const janitorUsage = `usage: babakoto_api [--config path] janitor <job>
+
+jobs:
+  purge-tokens          remove the expired access tokens
+  purge-signups         remove the users which did not verify their account in time
+  purge-deleted-users   remove the users deleted for longer than the retention
+  all                   run every job`
+
+// runJanitor run janitor jobs once, for cron, and return the exit code. The
+// lease is not taken, the jobs can safely run along the server.
+func runJanitor(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, janitorUsage)
+		return 2
+	}
+	jobs := []string{args[0]}
+	if args[0] == "all" {
+		jobs = janitor.Jobs
+	}
+	for _, job := range jobs {
+		if !contains(janitor.Jobs, job) {
+			fmt.Fprintln(os.Stderr, janitorUsage)
+			return 2
+		}
+	}
+
+	config, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if config.Dev {
+		fmt.Fprintln(os.Stderr, "nothing to clean in dev mode")
+		return 1
+	}
+	db, err := database.Open(config.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to the database: %s\n", err.Error())
+		return 1
+	}
+	defer db.Close()
+	if err := migrations.Check(db); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	cipher, err := pii.Load(config.Pii)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load the pii keys: %s\n", err.Error())
+		return 1
+	}
+	// the jobs only read what they delete, no replica
+	repos, store, err := openStore(dao.NewGormRepositories(db, nil, cipher), config.Store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open the token store: %s\n", err.Error())
+		return 1
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	failed := []string{}
+	for _, job := range jobs {
+		removed, err := janitor.Run(repos, config.Janitor, job, time.Now())
+		fmt.Printf("%s removed %d rows\n", job, removed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", job, err.Error())
+			failed = append(failed, job)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "failed jobs: %s\n", strings.Join(failed, ", "))
+		return 1
+	}
+	return 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package janitor
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/services/user"
+	"github.com/satori/go.uuid"
+)
+
+// names of the jobs, also the janitor subcommands
+const (
+	PurgeTokens       = "purge-tokens"
+	PurgeSignups      = "purge-signups"
+	PurgeDeletedUsers = "purge-deleted-users"
+)
+
+var Jobs = []string{PurgeTokens, PurgeSignups, PurgeDeletedUsers}
+
+const (
+	defaultTokensInterval       = 3600
+	defaultSignupsInterval      = 3600
+	defaultDeletedUsersInterval = 3600
+	// thirty days
+	defaultDeletedUsersRetention = 2592000
+	defaultLeaseTtl              = 60
+	// only one replica run the jobs, the one holding this lease
+	leaseName = "janitor"
+	// users purged by query
+	usersBatch = 100
+)
+
+// intervals are in seconds, 0 use the default
+type Config struct {
+	// run the jobs in the server, the janitor subcommand can be used from
+	// cron instead
+	Enabled              bool `json:"enabled"`
+	TokensInterval       int  `json:"tokens_interval"`
+	SignupsInterval      int  `json:"signups_interval"`
+	DeletedUsersInterval int  `json:"deleted_users_interval"`
+	// seconds a deleted user can be restored before being purged
+	DeletedUsersRetention int `json:"deleted_users_retention"`
+	// the lease is lost if not renewed for this long, e.g the replica died
+	LeaseTtl int `json:"lease_ttl"`
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func (c Config) withDefaults() Config {
+	c.TokensInterval = orDefault(c.TokensInterval, defaultTokensInterval)
+	c.SignupsInterval = orDefault(c.SignupsInterval, defaultSignupsInterval)
+	c.DeletedUsersInterval = orDefault(c.DeletedUsersInterval, defaultDeletedUsersInterval)
+	c.DeletedUsersRetention = orDefault(c.DeletedUsersRetention, defaultDeletedUsersRetention)
+	c.LeaseTtl = orDefault(c.LeaseTtl, defaultLeaseTtl)
+	return c
+}
+
+// Run execute the job once, return the number of removed rows
+func Run(repos dao.Repositories, c Config, job string, now time.Time) (int64, error) {
+	c = c.withDefaults()
+	var removed int64
+	var err error
+	switch job {
+	case PurgeTokens:
+		removed, err = purgeTokens(repos, now)
+	case PurgeSignups:
+		removed, err = purgeSignups(repos, now)
+	case PurgeDeletedUsers:
+		removed, err = purgeDeletedUsers(repos, now.Add(-seconds(c.DeletedUsersRetention)))
+	default:
+		return 0, fmt.Errorf("unknown janitor job %s", job)
+	}
+
+	metrics.JanitorRemoved.WithLabelValues(job).Add(float64(removed))
+	if err != nil {
+		metrics.JanitorRuns.WithLabelValues(job, "error").Inc()
+		log.Errorf("[janitor.Run] job %s failed after removing %d rows: %s", job, removed, err.Error())
+		return removed, err
+	}
+	metrics.JanitorRuns.WithLabelValues(job, "success").Inc()
+	log.Infof("[janitor.Run] job %s removed %d rows", job, removed)
+	return removed, nil
+}
+
+// purgeTokens remove the expired access tokens and rate limit counters
+func purgeTokens(repos dao.Repositories, now time.Time) (int64, error) {
+	removed, err := repos.AccessTokens.DeleteExpired(now)
+	if err != nil {
+		return removed, err
+	}
+	counters, err := repos.Counters.DeleteExpired(now)
+	return removed + counters, err
+}
+
+// purgeSignups remove the users which did not verify their account in time
+func purgeSignups(repos dao.Repositories, now time.Time) (int64, error) {
+	var removed int64
+	for {
+		usvs, err := repos.SignupVerifications.GetExpired(now, usersBatch)
+		if err != nil {
+			return removed, err
+		}
+		for _, usv := range usvs {
+			if err := user.Purge(repos, usv.UserId); err != nil {
+				return removed, err
+			}
+			log.Infof("[janitor.purgeSignups] unverified user [id=%s] purged", usv.UserId)
+			removed++
+		}
+		if len(usvs) < usersBatch {
+			return removed, nil
+		}
+	}
+}
+
+// purgeDeletedUsers remove the users deleted before t, they cannot be
+// restored anymore and their email and username are released
+func purgeDeletedUsers(repos dao.Repositories, t time.Time) (int64, error) {
+	var removed int64
+	for {
+		us, err := repos.Users.GetDeletedBefore(t, usersBatch)
+		if err != nil {
+			return removed, err
+		}
+		for _, u := range us {
+			if err := user.Purge(repos, u.Id); err != nil {
+				return removed, err
+			}
+			log.Infof("[janitor.purgeDeletedUsers] deleted user [id=%s] purged", u.Id)
+			removed++
+		}
+		if len(us) < usersBatch {
+			return removed, nil
+		}
+	}
+}
+
+// Janitor run the jobs periodically while this replica hold the lease
+type Janitor struct {
+	repos    dao.Repositories
+	config   Config
+	holder   string
+	leader   int32
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func New(repos dao.Repositories, c Config) *Janitor {
+	hostname, _ := os.Hostname()
+	return &Janitor{
+		repos:  repos,
+		config: c.withDefaults(),
+		holder: fmt.Sprintf("%s-%s", hostname, uuid.NewV4().String()[:8]),
+		stop:   make(chan struct{}),
+	}
+}
+
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+func (j *Janitor) Start() {
+	log.Infof("[janitor.Start] starting janitor as %s", j.holder)
+	// the lease is acquired before the first run of the jobs
+	j.renew()
+	j.wg.Add(4)
+	go j.elect()
+	go j.loop(PurgeTokens, seconds(j.config.TokensInterval))
+	go j.loop(PurgeSignups, seconds(j.config.SignupsInterval))
+	go j.loop(PurgeDeletedUsers, seconds(j.config.DeletedUsersInterval))
+}
+
+// Stop wait for the running jobs and release the lease so another replica
+// can take over without waiting for its expiration
+func (j *Janitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+		j.wg.Wait()
+		if j.isLeader() {
+			if err := j.repos.Leases.Release(leaseName, j.holder); err != nil {
+				log.Errorf("[janitor.Stop] unable to release the lease: %s", err.Error())
+			}
+			j.setLeader(false)
+		}
+	})
+}
+
+func (j *Janitor) isLeader() bool {
+	return atomic.LoadInt32(&j.leader) == 1
+}
+
+func (j *Janitor) setLeader(leader bool) {
+	if leader == j.isLeader() {
+		return
+	}
+	if leader {
+		atomic.StoreInt32(&j.leader, 1)
+		metrics.JanitorLeader.Set(1)
+		log.Infof("[janitor] %s is now running the jobs", j.holder)
+	} else {
+		atomic.StoreInt32(&j.leader, 0)
+		metrics.JanitorLeader.Set(0)
+		log.Infof("[janitor] %s stopped running the jobs", j.holder)
+	}
+}
+
+func (j *Janitor) renew() {
+	leader, err := j.repos.Leases.Acquire(leaseName, j.holder, seconds(j.config.LeaseTtl))
+	if err != nil {
+		// another replica will take over when the lease expire
+		log.Errorf("[janitor.renew] unable to acquire the lease: %s", err.Error())
+		leader = false
+	}
+	j.setLeader(leader)
+}
+
+// elect renew the lease well before its expiration
+func (j *Janitor) elect() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(seconds(j.config.LeaseTtl) / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.renew()
+		}
+	}
+}
+
+func (j *Janitor) loop(job string, interval time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if j.isLeader() {
+			Run(j.repos, j.config, job, time.Now())
+		}
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package janitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+func newTestUser(t *testing.T, repos dao.Repositories, id string) {
+	if err := repos.Users.Create(domain.User{Id: id, Username: id, Email: id + "@example.com", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeSignups(t *testing.T) {
+	repos := memory.NewRepositories()
+	now := time.Now()
+	newTestUser(t, repos, "expired")
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("expired", "expired", 60, now.Add(-time.Hour)))
+	newTestUser(t, repos, "pending")
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("pending", "pending", 3600, now))
+	newTestUser(t, repos, "verified")
+	// a verified user who changed his email
+	newTestUser(t, repos, "email-change")
+	usv := domain.NewUserSignupVerification("email-change", "email-change", 60, now.Add(-time.Hour))
+	usv.EmailChange = true
+	repos.SignupVerifications.Create(usv)
+
+	removed, err := Run(repos, Config{}, PurgeSignups, now)
+	if err != nil || removed != 1 {
+		t.Fatalf("expected one user purged, got %d: %v", removed, err)
+	}
+	if _, err := repos.Users.GetById("expired"); err == nil {
+		t.Fatalf("expected the user with an expired signup to be purged")
+	}
+	for _, id := range []string{"pending", "verified", "email-change"} {
+		if _, err := repos.Users.GetById(id); err != nil {
+			t.Fatalf("expected user %s to be kept: %s", id, err)
+		}
+	}
+}
+
+func TestPurgeTokens(t *testing.T) {
+	repos := memory.NewRepositories()
+	now := time.Now()
+	repos.AccessTokens.Create(domain.NewAccessToken("expired", "alice", 60, now.Add(-time.Hour)))
+	repos.AccessTokens.Create(domain.NewAccessToken("valid", "alice", 3600, now))
+
+	removed, err := Run(repos, Config{}, PurgeTokens, now)
+	if err != nil || removed != 1 {
+		t.Fatalf("expected one token removed, got %d: %v", removed, err)
+	}
+	if _, err := repos.AccessTokens.GetById("valid"); err != nil {
+		t.Fatalf("expected the valid token to be kept: %s", err)
+	}
+}
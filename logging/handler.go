@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"net/http"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/utils"
+	"github.com/jeremyletang/babakoto_api/utils/errmsg"
+)
+
+type LevelRequest struct {
+	Level string `json:"level"`
+}
+
+func GetLevel(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.WithName(Level(), "level"))
+}
+
+func PutLevel(w http.ResponseWriter, r *http.Request) {
+	var req LevelRequest
+	if err := utils.ReadRequestBody(r, &req); err != nil {
+		log.Errorf("[logging.PutLevel] invalid request body: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusBadRequest, jsend.Fail("invalid json"))
+		return
+	}
+	if req.Level == "" {
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName(errmsg.MissingFieldError, "level"))
+		return
+	}
+	if !isValidLevel(req.Level) {
+		utils.WriteJsonResponse(w, http.StatusBadRequest,
+			jsend.FailWithName("Invalid log level", "level"))
+		return
+	}
+
+	if err := SetLevel(req.Level); err != nil {
+		log.Errorf("[logging.PutLevel] unable to change log level: %s", err.Error())
+		utils.WriteJsonResponse(w, http.StatusConflict,
+			jsend.FailWithName(err.Error(), "level"))
+		return
+	}
+
+	utils.WriteJsonResponse(w, http.StatusOK, jsend.WithName(Level(), "level"))
+}
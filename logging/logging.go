@@ -0,0 +1,328 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultLevel       = "info"
+	defaultDatePattern = "2006-01-02"
+	defaultMaxSize     = 10 * 1024 * 1024
+	defaultMaxRolls    = 7
+)
+
+type FileConfig struct {
+	Path string `json:"path"`
+	// size or date, no rotation if empty
+	Rotate string `json:"rotate"`
+	// bytes before a size rotation
+	MaxSize int64 `json:"max_size"`
+	// go time layout, a new file is used when the formatted date change
+	DatePattern string `json:"date_pattern"`
+	// number of rotated files kept
+	MaxRolls int `json:"max_rolls"`
+}
+
+type Config struct {
+	// path to a seelog xml configuration, the other settings are ignored
+	// and the level cannot be changed at runtime
+	SeelogFile string `json:"seelog_file"`
+	// console (colored, for humans) or json (for log shippers)
+	Format string `json:"format"`
+	Level  string `json:"level"`
+	// minimum level by source path, e.g {"auth/ldap": "debug"}
+	Packages map[string]string `json:"packages"`
+	// the console output is disabled if set to true
+	NoConsole bool        `json:"no_console"`
+	File      *FileConfig `json:"file"`
+	// output of the json access log, console if nil
+	AccessLogFile *FileConfig `json:"access_log_file"`
+}
+
+// the current configuration, kept to rebuild the logger when the level change
+var (
+	mutex   sync.Mutex
+	current Config
+	level   string
+)
+
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// "password":"xxx", password: "xxx", Password:"xxx"
+	{regexp.MustCompile(`(?i)("?\b(?:password|passwd|secret|client_secret|bind_password|access_token|refresh_token|id_token|csrf_token|code)"?\s*[:=]\s*)"[^"]*"`), `${1}"[REDACTED]"`},
+	// password=xxx in query strings and forms
+	{regexp.MustCompile(`(?i)(\b(?:password|passwd|secret|client_secret|bind_password|access_token|refresh_token|id_token|csrf_token|code)=)[^&\s"]+`), `${1}[REDACTED]`},
+	// authorization headers
+	{regexp.MustCompile(`(?i)(\bbearer\s+)[a-z0-9\-._~+/]+=*`), `${1}[REDACTED]`},
+}
+
+// Redact remove the secrets (passwords, tokens ...) from a log message
+func Redact(message string) string {
+	for _, p := range secretPatterns {
+		message = p.re.ReplaceAllString(message, p.repl)
+	}
+	return message
+}
+
+func init() {
+	// %RedactedMsg is the message without secrets, %JsonMsg the same as a json string
+	log.RegisterCustomFormatter("RedactedMsg", func(string) log.FormatterFunc {
+		return func(message string, _ log.LogLevel, _ log.LogContextInterface) interface{} {
+			return Redact(message)
+		}
+	})
+	log.RegisterCustomFormatter("JsonMsg", func(string) log.FormatterFunc {
+		return func(message string, _ log.LogLevel, _ log.LogContextInterface) interface{} {
+			b, _ := json.Marshal(Redact(message))
+			return string(b)
+		}
+	})
+}
+
+const seelogTemplate = `
+<seelog minlevel="{{.Level}}">
+  {{- if .Packages}}
+  <exceptions>
+    {{- range .Packages}}
+    <exception filepattern="{{attr .Pattern}}" minlevel="{{.Level}}"/>
+    {{- end}}
+  </exceptions>
+  {{- end}}
+  <outputs formatid="{{.Format}}">
+    {{- if .Console}}
+    <console/>
+    {{- end}}
+    {{- with .File}}
+    {{- if eq .Rotate "size"}}
+    <rollingfile type="size" filename="{{attr .Path}}" maxsize="{{.MaxSize}}" maxrolls="{{.MaxRolls}}"/>
+    {{- else if eq .Rotate "date"}}
+    <rollingfile type="date" filename="{{attr .Path}}" datepattern="{{attr .DatePattern}}" maxrolls="{{.MaxRolls}}"/>
+    {{- else}}
+    <file path="{{attr .Path}}"/>
+    {{- end}}
+    {{- end}}
+  </outputs>
+  <formats>
+    <format id="colored" format="%Date(2006 Jan 02/3:04:05.00 PM MST) (%File) [%EscM(36)%LEVEL%EscM(39)] %RedactedMsg%n%EscM(0)"/>
+    <format id="json" format="{&quot;time&quot;:&quot;%UTCDate(2006-01-02T15:04:05.000Z)&quot;,&quot;level&quot;:&quot;%Level&quot;,&quot;file&quot;:&quot;%RelFile&quot;,&quot;line&quot;:%Line,&quot;msg&quot;:%JsonMsg}%n"/>
+    <format id="raw" format="%Msg%n"/>
+  </formats>
+</seelog>
+`
+
+var seelogTmpl = template.Must(template.New("seelog").
+	Funcs(template.FuncMap{"attr": escapeAttr}).
+	Parse(seelogTemplate))
+
+func escapeAttr(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+type packageLevel struct {
+	Pattern string
+	Level   string
+}
+
+type templateData struct {
+	Level    string
+	Format   string
+	Packages []packageLevel
+	Console  bool
+	File     *FileConfig
+}
+
+// fill the unset file settings with the defaults
+func withFileDefaults(f *FileConfig) *FileConfig {
+	if f == nil {
+		return nil
+	}
+	c := *f
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultMaxSize
+	}
+	if c.DatePattern == "" {
+		c.DatePattern = defaultDatePattern
+	}
+	if c.MaxRolls <= 0 {
+		c.MaxRolls = defaultMaxRolls
+	}
+	return &c
+}
+
+func isValidLevel(l string) bool {
+	lvl, ok := log.LogLevelFromString(l)
+	return ok && lvl != log.Off
+}
+
+func render(data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := seelogTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func buildConfig(c Config, lvl string) (string, error) {
+	if !isValidLevel(lvl) {
+		return "", fmt.Errorf("invalid log level %s", lvl)
+	}
+
+	data := templateData{
+		Level:   lvl,
+		Format:  "colored",
+		Console: !c.NoConsole,
+		File:    withFileDefaults(c.File),
+	}
+	switch c.Format {
+	case "", "console":
+	case "json":
+		data.Format = "json"
+	default:
+		return "", fmt.Errorf("invalid log format %s", c.Format)
+	}
+	if !data.Console && data.File == nil {
+		return "", errors.New("no log output configured")
+	}
+	if data.File != nil && data.File.Rotate != "" && data.File.Rotate != "size" && data.File.Rotate != "date" {
+		return "", fmt.Errorf("invalid log rotation %s", data.File.Rotate)
+	}
+
+	// sorted so the generated configuration is stable
+	paths := []string{}
+	for path := range c.Packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !isValidLevel(c.Packages[path]) {
+			return "", fmt.Errorf("invalid log level %s for %s", c.Packages[path], path)
+		}
+		data.Packages = append(data.Packages, packageLevel{
+			Pattern: "*" + strings.Trim(path, "/*") + "/*",
+			Level:   c.Packages[path],
+		})
+	}
+
+	return render(data)
+}
+
+// Validate check the configuration without replacing the logger
+func Validate(c Config) error {
+	if c.SeelogFile != "" {
+		return nil
+	}
+	lvl := c.Level
+	if lvl == "" {
+		lvl = defaultLevel
+	}
+	_, err := buildConfig(c, lvl)
+	return err
+}
+
+// Setup replace the global logger using the configuration
+func Setup(c Config) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var seelogXml string
+	var err error
+	lvl := c.Level
+	if lvl == "" {
+		lvl = defaultLevel
+	}
+
+	if c.SeelogFile != "" {
+		raw, err := ioutil.ReadFile(c.SeelogFile)
+		if err != nil {
+			return fmt.Errorf("unable to read seelog file: %s", err.Error())
+		}
+		seelogXml = string(raw)
+	} else if seelogXml, err = buildConfig(c, lvl); err != nil {
+		return err
+	}
+
+	logger, err := log.LoggerFromConfigAsString(seelogXml)
+	if err != nil {
+		return fmt.Errorf("invalid seelog configuration: %s", err.Error())
+	}
+	if err := log.ReplaceLogger(logger); err != nil {
+		return err
+	}
+
+	current = c
+	level = lvl
+	return nil
+}
+
+// NewAccessLogger create the logger of the access log, the messages are
+// already json lines
+func NewAccessLogger(c Config) (log.LoggerInterface, error) {
+	seelogXml, err := render(templateData{
+		Level:   "info",
+		Format:  "raw",
+		Console: c.AccessLogFile == nil,
+		File:    withFileDefaults(c.AccessLogFile),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return log.LoggerFromConfigAsString(seelogXml)
+}
+
+// Level return the current minimum level of the global logger
+func Level() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return level
+}
+
+func configuredLevel() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current.Level == "" {
+		return defaultLevel
+	}
+	return current.Level
+}
+
+// SetLevel rebuild the global logger with a new minimum level, the per
+// package levels and the outputs are kept
+func SetLevel(lvl string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if current.SeelogFile != "" {
+		return errors.New("the level of an external seelog configuration cannot be changed")
+	}
+	seelogXml, err := buildConfig(current, lvl)
+	if err != nil {
+		return err
+	}
+	logger, err := log.LoggerFromConfigAsString(seelogXml)
+	if err != nil {
+		return err
+	}
+	if err := log.ReplaceLogger(logger); err != nil {
+		return err
+	}
+
+	log.Infof("[logging.SetLevel] log level changed from %s to %s", level, lvl)
+	level = lvl
+	return nil
+}
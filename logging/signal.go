@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/cihub/seelog"
+)
+
+// HandleSignals toggle the debug level on SIGUSR1, a second SIGUSR1
+// restore the configured level
+func HandleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			next := "debug"
+			if Level() == next {
+				next = configuredLevel()
+			}
+			if err := SetLevel(next); err != nil {
+				log.Errorf("[logging.HandleSignals] unable to change log level: %s", err.Error())
+			}
+		}
+	}()
+}
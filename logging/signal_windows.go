@@ -0,0 +1,4 @@
+package logging
+
+// HandleSignals does nothing, there is no SIGUSR1 on windows
+func HandleSignals() {}
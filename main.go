@@ -1,141 +1,293 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/mux"
+	adminapi "github.com/jeremyletang/babakoto_api/admin"
+	"github.com/jeremyletang/babakoto_api/auth"
 	"github.com/jeremyletang/babakoto_api/auth/builtin"
-	"github.com/jeremyletang/babakoto_api/ctxext"
-	"github.com/jeremyletang/babakoto_api/jsend"
-	"github.com/jeremyletang/babakoto_api/services/user"
-	"github.com/jeremyletang/babakoto_api/utils"
+	"github.com/jeremyletang/babakoto_api/auth/ldap"
+	"github.com/jeremyletang/babakoto_api/auth/oidc"
+	"github.com/jeremyletang/babakoto_api/config"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/dao/redis"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/health"
+	"github.com/jeremyletang/babakoto_api/janitor"
+	"github.com/jeremyletang/babakoto_api/logging"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/middleware"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jeremyletang/babakoto_api/pii"
+	"github.com/jeremyletang/babakoto_api/server"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql"
-	"github.com/rs/cors"
+	goredis "github.com/redis/go-redis/v9"
 )
 
 var db *gorm.DB
-
-type MysqlConfig struct {
-	User     string `json:"user"`
-	Password string `json:"password"`
-	Ip       string `json:"ip"`
-	Port     string `json:"port"`
-	Database string `json:"database"`
-}
-
-type Config struct {
-	Mysql MysqlConfig `json:"mysql"`
-}
+var repos dao.Repositories
+var accessLogger log.LoggerInterface
+var checker *health.Checker
+var authCache *authcache.Cache
+var configPath = flag.String("config", config.DefaultPath, "path to the json configuration file")
 
 func init() {
-	logger, err := log.LoggerFromConfigAsString(seelogConfig)
-	if err != nil {
-		panic("unable to find logger configuration")
+	// default logger until the configuration is read
+	if err := logging.Setup(logging.Config{}); err != nil {
+		panic(fmt.Sprintf("unable to setup logger: %s", err.Error()))
 	}
-	log.ReplaceLogger(logger)
 }
 
-// "root:root@tcp(192.168.99.100:3307)/babakoto?parseTime=True"
-func getConfig() Config {
-	c, err := ioutil.ReadFile(".babakoto.config.json")
+func main() {
+	// read config
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "migrate":
+		os.Exit(migrate(flag.Args()[1:]))
+	case "janitor":
+		os.Exit(runJanitor(flag.Args()[1:]))
+	case "reencrypt":
+		os.Exit(runReencrypt(flag.Args()[1:]))
+	}
+	config, err := config.Load(*configPath)
 	if err != nil {
-		panic(fmt.Sprintf("[getConfig] unable to read config file: %s", err.Error()))
+		panic(fmt.Sprintf("[main] %s", err.Error()))
 	}
-
-	var config Config
-	if err := json.Unmarshal(c, &config); err != nil {
-		panic(fmt.Sprintf("[getConfig] invalid config format: %s", err.Error()))
+	// init logs
+	if err = logging.Setup(config.Logging); err != nil {
+		panic(fmt.Sprintf("[main] unable to setup logger: %s", err.Error()))
+	}
+	if accessLogger, err = logging.NewAccessLogger(config.Logging); err != nil {
+		panic(fmt.Sprintf("[main] unable to setup access logger: %s", err.Error()))
+	}
+	defer log.Flush()
+	defer accessLogger.Flush()
+	logging.HandleSignals()
+	// init db
+	if config.Dev {
+		log.Warn("Dev mode, the data is kept in memory and lost on restart")
+		repos = memory.NewRepositories()
+	} else {
+		if db, err = database.Open(config.Database); err != nil {
+			panic(fmt.Sprintf("[main] unable to initialize gorm: %s", err.Error()))
+		}
+		defer db.Close()
+		if err := migrations.Check(db); err != nil {
+			panic(fmt.Sprintf("[main] refusing to start: %s", err.Error()))
+		}
+		metrics.InstrumentDb(db, config.Database.Label())
+		replicas := database.OpenReplicas(config.Database)
+		defer replicas.Close()
+		replicas.Each(metrics.InstrumentDb)
+		cipher, err := pii.Load(config.Pii)
+		if err != nil {
+			panic(fmt.Sprintf("[main] unable to load the pii keys: %s", err.Error()))
+		}
+		if cipher == nil {
+			log.Warn("No pii key configured, the emails are stored in clear")
+		}
+		repos = dao.NewGormRepositories(db, replicas, cipher)
+	}
+	// repos is global, do not shadow it
+	var store *goredis.Client
+	if repos, store, err = openStore(repos, config.Store); err != nil {
+		panic(fmt.Sprintf("[main] unable to open the token store: %s", err.Error()))
+	}
+	if store != nil {
+		defer store.Close()
 	}
 
-	return config
-}
+	if config.Metrics.Listen != "" {
+		go func() {
+			log.Infof("Starting metrics server on %s", config.Metrics.Listen)
+			log.Critical(metrics.ListenAndServe(config.Metrics))
+		}()
+	}
 
-func main() {
-	// read config
-	config := getConfig()
-	// init db
-	var err error
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?parseTime=True",
-		config.Mysql.User,
-		config.Mysql.Password,
-		config.Mysql.Ip,
-		config.Mysql.Port,
-		config.Mysql.Database)
+	if config.Janitor.Enabled {
+		j := janitor.New(repos, config.Janitor)
+		j.Start()
+		defer j.Stop()
+	}
 
-	if db, err = gorm.Open("mysql", dsn); err != nil {
-		panic(fmt.Sprintf("[main] unable to initialize gorm: %s", err.Error()))
+	// the in-memory pub/sub only reach this replica, the others see the
+	// changes after the cache ttl
+	authCache = authcache.New(config.Auth.Cache, authcache.NewMemoryPubSub())
+	checker = health.NewChecker(db, store, 0)
+	r := makeRoutes(config)
+	corsPolicy := middleware.NewCors(config.Cors)
+	go handleReload(corsPolicy)
+	handler := middleware.Chain(r,
+		middleware.RequestId(),
+		middleware.AccessLog(accessLogger),
+		middleware.Metrics(),
+		corsPolicy.Middleware())
+	srv, err := server.New(config.Server, handler)
+	if err != nil {
+		panic(fmt.Sprintf("[main] invalid server config: %s", err.Error()))
+	}
+	drained := make(chan struct{})
+	go handleShutdown(srv, drained)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Critical(err)
+		return
 	}
-	defer db.Close()
+	// the database is closed once the requests are drained
+	<-drained
+	log.Info("Http server stopped")
+}
 
-	r := makeRoutes()
-	handler := cors.New(cors.Options{AllowedHeaders: []string{"*"}, AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"}}).Handler(r)
-	log.Info("Starting http server")
-	log.Critical(http.ListenAndServe(fmt.Sprintf(":%v", 9992), handler))
+// handleShutdown mark the server as not ready on SIGTERM or SIGINT then
+// wait for the in flight requests, drained is closed once done
+func handleShutdown(srv *server.Server, drained chan struct{}) {
+	defer close(drained)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	sig := <-c
+	log.Infof("Received %s, shutting down", sig)
+	checker.ShuttingDown()
+	// no orchestrator to wait for when stopped from a terminal
+	if sig == syscall.SIGTERM {
+		time.Sleep(time.Duration(srv.Config().ShutdownDelay) * time.Second)
+	}
+	if err := srv.Shutdown(); err != nil {
+		log.Errorf("[main.handleShutdown] unable to drain the requests: %s", err.Error())
+	}
+}
 
+// handleReload read the configuration again on SIGHUP and apply the parts
+// which can change without restart (the cors policy)
+func handleReload(corsPolicy *middleware.Cors) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		conf, err := config.Load(*configPath)
+		if err != nil {
+			log.Errorf("[main.handleReload] configuration not reloaded: %s", err.Error())
+			continue
+		}
+		corsPolicy.Update(conf.Cors)
+		log.Infof("Cors policy reloaded, allowed origins: %v", conf.Cors.AllowedOrigins)
+	}
 }
 
-func makeRoutes() *mux.Router {
+func makeRoutes(config config.Config) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(middleware.Route())
+
+	// probes of the orchestrator
+	r.HandleFunc("/healthz", checker.Live).Methods("GET")
+	r.HandleFunc("/readyz", checker.Ready).Methods("GET")
 
 	// builtin auth routes
-	builtinAuth := builtinauth.NewBuiltinAuth(db)
+	builtinAuth := builtinauth.NewBuiltinAuth(repos, makeAuthProvider(config.Auth), authCache,
+		config.Session, config.Auth.Tokens, config.Auth.LoginLimit)
 	r.HandleFunc("/api/v1/user/login",
 		builtinAuth.Login).Methods("POST")
 	r.HandleFunc("/api/v1/user/signup",
 		builtinAuth.Signup).Methods("POST")
 	r.HandleFunc("/api/v1/user/verify/{id}",
 		builtinAuth.Verify).Methods("GET")
+	// external openid connect providers
+	if len(config.Auth.Oidc) > 0 {
+		oidcAuth, err := oidcauth.NewOidcAuth(repos, config.Auth.Oidc, config.Session, config.Auth.Tokens)
+		if err != nil {
+			panic(fmt.Sprintf("[makeRoutes] unable to initialize oidc auth: %s", err.Error()))
+		}
+		r.HandleFunc("/api/v1/user/oidc/{provider}/login",
+			oidcAuth.Login).Methods("GET")
+		r.HandleFunc("/api/v1/user/oidc/{provider}/callback",
+			oidcAuth.Callback).Methods("GET")
+	}
 	// need login
-	r.HandleFunc("/api/v1/user/token-infos",
-		addContext(addUserInfo(builtinAuth.TokenInfos, db))).Methods("GET")
-	r.HandleFunc("/api/v1/user/logout",
-		addContext(addUserInfo(builtinAuth.Logout, db))).Methods("GET")
+	r.Handle("/api/v1/user/token-infos",
+		verified(builtinAuth.TokenInfos, config)).Methods("GET")
+	r.Handle("/api/v1/user/logout",
+		verified(builtinAuth.Logout, config)).Methods("GET", "POST")
+	// the account can be managed before being verified
+	r.Handle("/api/v1/user/password",
+		authenticated(builtinAuth.ChangePassword, config)).Methods("PUT")
+	r.Handle("/api/v1/user",
+		authenticated(builtinAuth.UpdateProfile, config)).Methods("PATCH")
+	r.Handle("/api/v1/user",
+		authenticated(builtinAuth.DeleteAccount, config)).Methods("DELETE")
+	r.Handle("/api/v1/user/sessions",
+		authenticated(builtinAuth.Sessions, config)).Methods("GET")
+
+	// admin routes
+	admin := middleware.RequirePermission(repos, domain.PermissionAdmin)
+	r.Handle("/api/v1/admin/logging/level",
+		verified(logging.GetLevel, config, admin)).Methods("GET")
+	r.Handle("/api/v1/admin/logging/level",
+		verified(logging.PutLevel, config, admin)).Methods("PUT")
+	adminUsers := adminapi.NewUsers(repos, authCache)
+	r.Handle("/api/v1/admin/users",
+		verified(adminUsers.List, config, admin)).Methods("GET")
+	r.Handle("/api/v1/admin/users/{id}/restore",
+		verified(adminUsers.Restore, config, admin)).Methods("POST")
+	adminAuditEvents := adminapi.NewAuditEvents(repos)
+	r.Handle("/api/v1/admin/audit-events",
+		verified(adminAuditEvents.List, config, admin)).Methods("GET")
 
 	return r
 }
 
-func getToken(r *http.Request) (string, error) {
-	var token string
-	if token = r.Header.Get("authorization"); token == "" {
-		if token = r.Header.Get("Authorization"); token == "" {
-			if token = r.Form.Get("access_token"); token == "" {
-				return token, errors.New("Missing access token")
-			}
+func makeAuthProvider(config config.AuthConfig) auth.Provider {
+	available := map[string]auth.Provider{}
+	builtinProvider := builtinauth.NewProvider(repos)
+	available[builtinProvider.Name()] = builtinProvider
+	if config.Ldap != nil {
+		ldapProvider, err := ldapauth.NewProvider(repos, *config.Ldap, config.Tokens)
+		if err != nil {
+			panic(fmt.Sprintf("[makeAuthProvider] invalid ldap config: %s", err.Error()))
 		}
+		available[ldapProvider.Name()] = ldapProvider
 	}
 
-	return token, nil
+	chain, err := auth.NewChain(config.Providers, available)
+	if err != nil {
+		panic(fmt.Sprintf("[makeAuthProvider] invalid auth providers: %s", err.Error()))
+	}
+	log.Infof("Login providers: %v", config.Providers)
+	return chain
 }
 
-func addUserInfo(
-	f func(context.Context, http.ResponseWriter, *http.Request),
-	db *gorm.DB,
-) func(context.Context, http.ResponseWriter, *http.Request) {
-	return user.AddUserInfoToContext(f, db)
+// openStore keep the access tokens and the rate limit counters of repos in
+// redis if configured, the client is then returned to be closed on exit
+func openStore(repos dao.Repositories, c config.StoreConfig) (dao.Repositories, *goredis.Client, error) {
+	if c.Driver != config.StoreRedis {
+		return repos, nil, nil
+	}
+	client, err := redis.Open(c.Redis)
+	if err != nil {
+		return repos, nil, err
+	}
+	log.Infof("Access tokens and counters are kept in redis at %s", c.Redis.Addr)
+	return redis.NewRepositories(repos, client, c.Redis), client, nil
 }
 
-func addContext(
-	f func(context.Context, http.ResponseWriter, *http.Request),
-) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := getToken(r)
-
-		if err != nil {
-			utils.WriteJsonResponse(w, http.StatusUnauthorized,
-				jsend.FailWithName(err.Error(), "access_token"))
-			return
-		}
+// authenticated wrap f so it is only called with a valid access token,
+// the token and the user are in the request context
+func authenticated(f http.HandlerFunc, config config.Config, middlewares ...middleware.Middleware) http.Handler {
+	return middleware.Chain(f, append([]middleware.Middleware{
+		middleware.Authenticate(config.Auth.AllowQueryToken, config.Session),
+		middleware.LoadUser(repos, authCache),
+	}, middlewares...)...)
+}
 
-		ctx := ctxext.AddAccessTokenString(context.Background(), token)
-		// finally call the handler
-		f(ctx, w, r)
-	}
+// verified is the same as authenticated but the user must have validated his account
+func verified(f http.HandlerFunc, config config.Config, middlewares ...middleware.Middleware) http.Handler {
+	return authenticated(f, config,
+		append([]middleware.Middleware{middleware.RequireVerified(repos, authCache)}, middlewares...)...)
 }
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "babakoto"
+
+type Config struct {
+	// address of the metrics listener, e.g ":9993", disabled if empty
+	Listen string `json:"listen"`
+}
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of http requests by route template and status.",
+	}, []string{"method", "route", "status"})
+
+	HttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the http requests by route template and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by result and failure reason.",
+	}, []string{"result", "reason"})
+
+	Signups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Number of created users by source (builtin or external).",
+	}, []string{"source"})
+
+	Verifications = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signup_verifications_total",
+		Help:      "Number of users which validated their account.",
+	})
+
+	TokensIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "access_tokens_issued_total",
+		Help:      "Number of access tokens created.",
+	})
+
+	DbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of the database queries by operation and table.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	JanitorRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_runs_total",
+		Help:      "Number of janitor job runs by job and result.",
+	}, []string{"job", "result"})
+
+	JanitorRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_removed_total",
+		Help:      "Number of rows removed by the janitor by job.",
+	}, []string{"job"})
+
+	JanitorLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "janitor_leader",
+		Help:      "1 if this replica hold the janitor lease and run the jobs.",
+	})
+
+	AuthCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_cache_lookups_total",
+		Help:      "Number of lookups of the access tokens cache by result (hit or miss).",
+	}, []string{"result"})
+
+	AuthCacheInvalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_cache_invalidations_total",
+		Help:      "Number of invalidations of the access tokens cache by kind (token or user).",
+	}, []string{"kind"})
+)
+
+// login failure reasons
+const (
+	ReasonInvalidRequest     = "invalid_request"
+	ReasonUnknownIdentifier  = "unknown_identifier"
+	ReasonInvalidCredentials = "invalid_credentials"
+	ReasonEmailAlreadyUsed   = "email_already_used"
+	ReasonAccountDeleted     = "account_deleted"
+	ReasonRateLimited        = "rate_limited"
+	ReasonUpstreamError      = "upstream_error"
+	ReasonInternalError      = "internal_error"
+)
+
+func init() {
+	prometheus.MustRegister(
+		HttpRequests,
+		HttpDuration,
+		Logins,
+		Signups,
+		Verifications,
+		TokensIssued,
+		DbQueryDuration,
+		JanitorRuns,
+		JanitorRemoved,
+		JanitorLeader,
+		AuthCacheLookups,
+		AuthCacheInvalidations,
+	)
+}
+
+func LoginSucceeded() {
+	Logins.WithLabelValues("success", "").Inc()
+}
+
+func LoginFailed(reason string) {
+	Logins.WithLabelValues("failure", reason).Inc()
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ListenAndServe serve /metrics on its own listener so it is not exposed
+// with the api
+func ListenAndServe(c Config) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(c.Listen, mux)
+}
+
+const startKey = "metrics:start"
+
+func before(scope *gorm.Scope) {
+	scope.Set(startKey, time.Now())
+}
+
+func after(operation string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		if v, ok := scope.Get(startKey); ok {
+			if start, ok := v.(time.Time); ok {
+				DbQueryDuration.WithLabelValues(operation, scope.TableName()).
+					Observe(time.Since(start).Seconds())
+			}
+		}
+	}
+}
+
+// InstrumentDb observe the duration of the gorm queries and export the
+// stats of the connection pool
+func InstrumentDb(db *gorm.DB, name string) {
+	callback := db.Callback()
+	callback.Create().Before("gorm:create").Register("metrics:before_create", before)
+	callback.Create().After("gorm:create").Register("metrics:after_create", after("create"))
+	callback.Query().Before("gorm:query").Register("metrics:before_query", before)
+	callback.Query().After("gorm:query").Register("metrics:after_query", after("query"))
+	callback.Update().Before("gorm:update").Register("metrics:before_update", before)
+	callback.Update().After("gorm:update").Register("metrics:after_update", after("update"))
+	callback.Delete().Before("gorm:delete").Register("metrics:before_delete", before)
+	callback.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete"))
+	callback.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", before)
+	callback.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", after("row_query"))
+
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db.DB(), name))
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+	"github.com/rs/cors"
+)
+
+type CorsConfig struct {
+	// exact origins or patterns with one wildcard, e.g https://*.example.com,
+	// "*" allow any origin and cannot be used with the credentials
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	// the request id header is always exposed
+	ExposedHeaders []string `json:"exposed_headers"`
+	// allow the browsers to send the session cookies
+	AllowCredentials bool `json:"allow_credentials"`
+	// seconds the browsers can cache a preflight response, -1 disable the cache
+	MaxAge int `json:"max_age"`
+}
+
+// Cors apply the cors policy given to Update, so it can be replaced
+// without a restart
+type Cors struct {
+	policy atomic.Value
+}
+
+func NewCors(c CorsConfig) *Cors {
+	p := &Cors{}
+	p.Update(c)
+	return p
+}
+
+// Update replace the policy used for the next requests
+func (p *Cors) Update(c CorsConfig) {
+	exposed := append([]string{RequestIdHeader, "ETag"}, c.ExposedHeaders...)
+	p.policy.Store(cors.New(cors.Options{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		ExposedHeaders:   exposed,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}))
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Middleware answer the preflight requests and add the cors headers to the
+// other responses
+func (p *Cors) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := p.policy.Load().(*cors.Cors)
+			policy.ServeHTTP(w, r, next.ServeHTTP)
+
+			// the preflight is answered without the allow headers when rejected
+			if isPreflight(r) && w.Header().Get("Access-Control-Allow-Origin") == "" {
+				log.Warnf("[middleware.Cors] preflight rejected: origin=%s method=%s headers=%s",
+					r.Header.Get("Origin"),
+					r.Header.Get("Access-Control-Request-Method"),
+					strings.Join(r.Header["Access-Control-Request-Headers"], ","))
+			}
+		})
+	}
+}
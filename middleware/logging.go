@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/gorilla/mux"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	RequestIdHeader = "X-Request-Id"
+	// longer request ids sent by the clients are replaced
+	maxRequestIdLength = 128
+)
+
+// responseWriter keep the status and the size of the response for the logs,
+// and the request id so it can be added to the jsend responses
+type responseWriter struct {
+	http.ResponseWriter
+	requestId string
+	status    int
+	bytes     int
+}
+
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// RequestId is used by utils.WriteJsonResponse
+func (rw *responseWriter) RequestId() string {
+	return rw.requestId
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestId use the X-Request-Id sent by the client or generate a new one,
+// the id is sent back in the header and in the jsend response
+func RequestId() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIdHeader)
+			if !isValidRequestId(id) {
+				id = uuid.NewV4().String()
+			}
+
+			rw := wrapResponseWriter(w)
+			rw.requestId = id
+			rw.Header().Set(RequestIdHeader, id)
+
+			ctx := r.Context()
+			if ri, ok := ctxext.ExtractRequestInfo(ctx); ok {
+				ri.Id = id
+			} else {
+				ctx = ctxext.AddRequestInfo(ctx, &ctxext.RequestInfo{Id: id})
+			}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// Route save the matched route template in the request infos, must be
+// added to the router with Use
+func Route() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ri, ok := ctxext.ExtractRequestInfo(r.Context()); ok {
+				if route := mux.CurrentRoute(r); route != nil {
+					ri.Route, _ = route.GetPathTemplate()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestId  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route"`
+	Status     int     `json:"status"`
+	LatencyMs  float64 `json:"latency_ms"`
+	UserId     string  `json:"user_id,omitempty"`
+	Bytes      int     `json:"bytes"`
+	RemoteAddr string  `json:"remote_addr"`
+	UserAgent  string  `json:"user_agent"`
+}
+
+// AccessLog write a json line to logger for each request once it is served
+func AccessLog(logger log.LoggerInterface) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := wrapResponseWriter(w)
+
+			ctx := r.Context()
+			ri, ok := ctxext.ExtractRequestInfo(ctx)
+			if !ok {
+				ri = &ctxext.RequestInfo{}
+				ctx = ctxext.AddRequestInfo(ctx, ri)
+			}
+
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			entry := accessLogEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				RequestId:  ri.Id,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Route:      ri.Route,
+				Status:     status,
+				LatencyMs:  float64(time.Since(start)) / float64(time.Millisecond),
+				UserId:     ri.UserId,
+				Bytes:      rw.bytes,
+				RemoteAddr: r.RemoteAddr,
+				UserAgent:  r.UserAgent(),
+			}
+			line, err := json.Marshal(entry)
+			if err != nil {
+				log.Errorf("[middleware.AccessLog] unable to marshal access log: %s", err.Error())
+				return
+			}
+			logger.Info(string(line))
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/metrics"
+)
+
+// methodLabel keep the standard methods, the others are counted together
+// so a client cannot create new series
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// Metrics count the requests and observe their latency by route template,
+// the path is never used as a label to keep the cardinality low
+func Metrics() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := wrapResponseWriter(w)
+
+			ctx := r.Context()
+			ri, ok := ctxext.ExtractRequestInfo(ctx)
+			if !ok {
+				ri = &ctxext.RequestInfo{}
+				ctx = ctxext.AddRequestInfo(ctx, ri)
+			}
+
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := ri.Route
+			if route == "" {
+				route = "unmatched"
+			}
+			labels := []string{methodLabel(r.Method), route, strconv.Itoa(status)}
+			metrics.HttpRequests.WithLabelValues(labels...).Inc()
+			metrics.HttpDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMethodLabel(t *testing.T) {
+	h := Chain(http.NotFoundHandler(), RequestId(), Metrics())
+	for _, method := range []string{"GET", "DELETE", "PROPFIND", "X-RANDOM-1", "get"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+	}
+
+	for label, expected := range map[string]float64{"GET": 1, "DELETE": 1, "other": 3} {
+		c := metrics.HttpRequests.WithLabelValues(label, "unmatched", "404")
+		if n := testutil.ToFloat64(c); n != expected {
+			t.Fatalf("%s: expected %v requests, got %v", label, expected, n)
+		}
+	}
+	for _, method := range []string{"PROPFIND", "X-RANDOM-1", "get"} {
+		if metrics.HttpRequests.DeleteLabelValues(method, "unmatched", "404") {
+			t.Fatalf("expected no series for %s", method)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"net/http"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/jsend"
+	"github.com/jeremyletang/babakoto_api/services/authcache"
+	"github.com/jeremyletang/babakoto_api/services/user"
+	"github.com/jeremyletang/babakoto_api/session"
+	"github.com/jeremyletang/babakoto_api/utils"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain wrap h with the middlewares, the first one is the first to
+// see the request
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Authenticate add the access token string of the request to the context,
+// from the Authorization header or the session cookie
+func Authenticate(allowQueryToken bool, sessions session.Config) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := auth.GetBearerToken(r, allowQueryToken)
+			ctx := r.Context()
+
+			// no token sent explicitly, try the browser session
+			if err == auth.ErrMissingToken && sessions.Enabled {
+				if cookieToken, ok := session.GetToken(r, sessions); ok {
+					if !session.CheckCsrf(r, sessions) {
+						utils.WriteJsonResponse(w, http.StatusForbidden,
+							jsend.FailWithName("Invalid csrf token", "csrf_token"))
+						return
+					}
+					token, err = cookieToken, nil
+					ctx = ctxext.AddFromSessionCookie(ctx)
+				}
+			}
+
+			if err != nil {
+				err.Write(w)
+				return
+			}
+
+			ctx = ctxext.AddAccessTokenString(ctx, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// LoadUser add the access token and its user to the context, must be used
+// after Authenticate. They are read from cache if not nil.
+func LoadUser(repos dao.Repositories, cache *authcache.Cache) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, ok := ctxext.ExtractAccessTokenString(r.Context())
+			if !ok {
+				auth.ErrMissingToken.Write(w)
+				return
+			}
+
+			token, u, err := cache.GetAccessTokenAndUser(repos, tokenString)
+			if err != nil {
+				if _, ok := err.(*auth.TokenError); !ok {
+					log.Errorf("[middleware.LoadUser] unable to get access token: %s", err.Error())
+				}
+				utils.WriteError(w, err)
+				return
+			}
+
+			if ri, ok := ctxext.ExtractRequestInfo(r.Context()); ok {
+				ri.UserId = u.Id
+			}
+
+			ctx := ctxext.AddUser(r.Context(), u)
+			ctx = ctxext.AddAccessToken(ctx, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireVerified reject the users which have not validated their account,
+// must be used after LoadUser
+func RequireVerified(repos dao.Repositories, cache *authcache.Cache) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, ok := ctxext.ExtractUser(r.Context())
+			token, ok2 := ctxext.ExtractAccessToken(r.Context())
+			if !ok || !ok2 {
+				log.Errorf("[middleware.RequireVerified] no user or access token in context")
+				utils.WriteJsonResponse(w, http.StatusInternalServerError,
+					jsend.Error("internal error"))
+				return
+			}
+
+			verified, err := cache.IsVerified(repos, token.Id, u.Id)
+			if err != nil {
+				log.Errorf("[middleware.RequireVerified] unable to get signup verification of user [id=%s]: %s",
+					u.Id, err.Error())
+				utils.WriteError(w, err)
+				return
+			}
+			if !verified {
+				auth.ErrUnverifiedUser.Write(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission reject the users without permission, must be used
+// after LoadUser
+func RequirePermission(repos dao.Repositories, permission string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, ok := ctxext.ExtractUser(r.Context())
+			if !ok {
+				log.Errorf("[middleware.RequirePermission] no user in context")
+				utils.WriteJsonResponse(w, http.StatusInternalServerError,
+					jsend.Error("internal error"))
+				return
+			}
+
+			has, err := user.HasPermission(repos, u.Id, permission)
+			if err != nil {
+				log.Errorf("[middleware.RequirePermission] unable to get permissions of user [id=%s]: %s",
+					u.Id, err.Error())
+				utils.WriteError(w, err)
+				return
+			}
+			if !has {
+				log.Errorf("[middleware.RequirePermission] user [id=%s] is missing permission %s",
+					u.Id, permission)
+				utils.WriteJsonResponse(w, http.StatusForbidden,
+					jsend.FailWithName("Missing permission "+permission, "permission"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
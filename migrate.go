@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jeremyletang/babakoto_api/config"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jinzhu/gorm"
+)
+
+const migrateUsage = `usage: babakoto_api [--config path] migrate <command>
+
+commands:
+  up [n]                       apply the pending migrations, or only the next n
+  down [n]                     revert the last n migrations (default 1)
+  status                       list the migrations and when they were applied
+  create [--dir path] <name>   add the up and down files of a new migration`
+
+// migrate run the migrate subcommand and return the exit code
+func migrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	// create only touch the source tree, no database needed
+	if args[0] == "create" {
+		return migrateCreate(args[1:])
+	}
+
+	n, err := countArg(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	config, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if config.Dev {
+		fmt.Fprintln(os.Stderr, "no database to migrate in dev mode")
+		return 1
+	}
+	db, err := database.Open(config.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to the database: %s\n", err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	var done []migrations.Migration
+	switch args[0] {
+	case "up":
+		done, err = migrations.Up(db, n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		done, err = migrations.Down(db, n)
+	case "status":
+		return migrateStatus(db)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	for _, m := range done {
+		fmt.Printf("%s %d_%s\n", args[0], m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("nothing to do")
+	}
+	return 0
+}
+
+func countArg(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, errors.New("the number of migrations must be a positive integer")
+	}
+	return n, nil
+}
+
+func migrateStatus(db *gorm.DB) int {
+	status, err := migrations.GetStatus(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range status {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		if s.Modified {
+			appliedAt += " (modified)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	w.Flush()
+	return 0
+}
+
+func migrateCreate(args []string) int {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	dir := fs.String("dir", "migrations", "directory of the migration files")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	paths, err := migrations.Create(*dir, fs.Arg(0))
+	for _, path := range paths {
+		fmt.Printf("created %s\n", path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
@@ -1 +0,0 @@
-CREATE DATABASE IF NOT EXISTS babakoto;
@@ -0,0 +1,354 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jinzhu/gorm"
+)
+
+// the migrations are embedded in the binary, a new migration is only
+// available after a rebuild. There is one folder by gorm dialect.
+//
+//go:embed mysql/*.sql postgres/*.sql sqlite3/*.sql
+var files embed.FS
+
+// Dialects have the same migrations, written in their own syntax
+var Dialects = []string{"mysql", "postgres", "sqlite3"}
+
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+var fileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var ErrSchemaBehind = errors.New("the database schema is behind, run `migrate up`")
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// SchemaMigration is a row of schema_migrations, one per applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// the embedded migration is not the one which was applied
+	Modified bool
+}
+
+func checksum(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+func parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := fileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		raw, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(raw)
+			mig.Checksum = checksum(mig.Up)
+		} else {
+			mig.Down = string(raw)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// All return the embedded migrations of the dialect sorted by version
+func All(dialect string) ([]Migration, error) {
+	sub, err := fs.Sub(files, dialect)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := parse(sub)
+	if err == nil && len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations for the %s dialect", dialect)
+	}
+	return migrations, err
+}
+
+// statements split a migration file, the statements must end with a ;
+// at the end of a line
+func statements(sql string) []string {
+	stmts := []string{}
+	current := []string{}
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(strings.Join(current, "\n")), ";"))
+			current = []string{}
+		}
+	}
+	if len(current) > 0 {
+		stmts = append(stmts, strings.TrimSpace(strings.Join(current, "\n")))
+	}
+	return stmts
+}
+
+func ensureTable(db *gorm.DB) error {
+	return db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations
+(
+  version    INTEGER      NOT NULL,
+  name       VARCHAR(255) NOT NULL,
+  checksum   VARCHAR(64)  NOT NULL,
+  applied_at TIMESTAMP    NOT NULL,
+  PRIMARY KEY (version)
+)`).Error
+}
+
+func applied(db *gorm.DB) (map[int]SchemaMigration, error) {
+	rows := []SchemaMigration{}
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byVersion := map[int]SchemaMigration{}
+	for _, r := range rows {
+		byVersion[r.Version] = r
+	}
+	return byVersion, nil
+}
+
+// GetStatus list the embedded migrations and if they are applied
+func GetStatus(db *gorm.DB) ([]Status, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+	return getStatus(db)
+}
+
+func getStatus(db *gorm.DB) ([]Status, error) {
+	migrations, err := All(db.Dialect().GetName())
+	if err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []Status{}
+	for _, m := range migrations {
+		s := Status{Migration: m}
+		if row, ok := done[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = row.AppliedAt
+			s.Modified = row.Checksum != m.Checksum
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+func verify(status []Status) error {
+	for _, s := range status {
+		if s.Modified {
+			return fmt.Errorf("migration %d_%s was modified after being applied (checksum mismatch)",
+				s.Version, s.Name)
+		}
+	}
+	return nil
+}
+
+// Check return ErrSchemaBehind if a migration is not applied, or an error if
+// an applied migration was modified. The database is not modified so it can
+// be used by the readiness probe.
+func Check(db *gorm.DB) error {
+	if !db.HasTable(SchemaMigration{}.TableName()) {
+		return ErrSchemaBehind
+	}
+	status, err := getStatus(db)
+	if err != nil {
+		return err
+	}
+	if err := verify(status); err != nil {
+		return err
+	}
+	for _, s := range status {
+		if !s.Applied {
+			return ErrSchemaBehind
+		}
+	}
+	return nil
+}
+
+// run the statements and update schema_migrations in a transaction, mysql
+// commit the ddl statements implicitly so a failed migration may have to be
+// cleaned by hand, this is why the migrations use IF NOT EXISTS
+func run(db *gorm.DB, sql string, record func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, stmt := range statements(sql) {
+		if err := tx.Exec(stmt).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Up apply at most n pending migrations, all of them if n <= 0
+func Up(db *gorm.DB, n int) ([]Migration, error) {
+	status, err := GetStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(status); err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, s := range status {
+		if s.Applied {
+			continue
+		}
+		if n > 0 && len(done) == n {
+			break
+		}
+		m := s.Migration
+		err := run(db, m.Up, func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				Checksum:  m.Checksum,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %s", m.Version, m.Name, err.Error())
+		}
+		log.Infof("[migrations.Up] migration %d_%s applied", m.Version, m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down revert the last n applied migrations
+func Down(db *gorm.DB, n int) ([]Migration, error) {
+	status, err := GetStatus(db)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for i := len(status) - 1; i >= 0 && len(done) < n; i-- {
+		m := status[i].Migration
+		if !status[i].Applied {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+		err := run(db, m.Down, func(tx *gorm.DB) error {
+			return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("revert of migration %d_%s failed: %s", m.Version, m.Name, err.Error())
+		}
+		log.Infof("[migrations.Down] migration %d_%s reverted", m.Version, m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+var nameRe = regexp.MustCompile(`^\w+$`)
+
+// Create write the up and down files of every dialect for the next version
+// in dir, the source directory of this package
+func Create(dir, name string) ([]string, error) {
+	if !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name %s, only letters, digits and _ are allowed", name)
+	}
+	version := 1
+	for _, dialect := range Dialects {
+		existing, err := parse(os.DirFS(filepath.Join(dir, dialect)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the %s migrations in %s: %s", dialect, dir, err.Error())
+		}
+		if len(existing) > 0 && existing[len(existing)-1].Version >= version {
+			version = existing[len(existing)-1].Version + 1
+		}
+	}
+
+	paths := []string{}
+	for _, dialect := range Dialects {
+		for _, direction := range []string{"up", "down"} {
+			path := filepath.Join(dir, dialect, fmt.Sprintf("%d_%s.%s.sql", version, name, direction))
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return paths, err
+			}
+			fmt.Fprintf(f, "-- %s %s for %s, every statement must end with a ;\n", name, direction, dialect)
+			f.Close()
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,173 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jinzhu/gorm"
+)
+
+func TestStatements(t *testing.T) {
+	sql := `-- a comment
+CREATE TABLE a
+(
+  id INTEGER NOT NULL
+);
+
+  -- indented comment
+CREATE INDEX a_id ON a (id);
+DROP TABLE b`
+	expected := []string{
+		"CREATE TABLE a\n(\n  id INTEGER NOT NULL\n)",
+		"CREATE INDEX a_id ON a (id)",
+		"DROP TABLE b",
+	}
+	if stmts := statements(sql); !reflect.DeepEqual(stmts, expected) {
+		t.Fatalf("expected %q, got %q", expected, stmts)
+	}
+	if stmts := statements("-- nothing\n\n"); len(stmts) != 0 {
+		t.Fatalf("expected no statement, got %q", stmts)
+	}
+}
+
+func TestParse(t *testing.T) {
+	migrations, err := parse(fstest.MapFS{
+		"10_b.up.sql":   {Data: []byte("B;")},
+		"2_a.up.sql":    {Data: []byte("A;")},
+		"2_a.down.sql":  {Data: []byte("DROP A;")},
+		"README.md":     {Data: []byte("not a migration")},
+		"3_c.upper.sql": {Data: []byte("ignored;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted by version, not by name
+	if len(migrations) != 2 || migrations[0].Version != 2 || migrations[1].Version != 10 {
+		t.Fatalf("unexpected migrations %+v", migrations)
+	}
+	if migrations[0].Down != "DROP A;" || migrations[0].Checksum != checksum("A;") || migrations[1].Down != "" {
+		t.Fatalf("unexpected migration %+v", migrations[0])
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"no up":     {"1_a.down.sql": {Data: []byte("DROP A;")}},
+		"two names": {"1_a.up.sql": {Data: []byte("A;")}, "1_b.down.sql": {Data: []byte("DROP B;")}},
+	} {
+		if _, err := parse(fsys); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDialects(t *testing.T) {
+	sqlite, err := All("sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every dialect has the same migrations
+	for _, dialect := range Dialects {
+		migrations, err := All(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) != len(sqlite) {
+			t.Fatalf("%s: expected %d migrations, got %d", dialect, len(sqlite), len(migrations))
+		}
+		for i, m := range migrations {
+			if m.Version != sqlite[i].Version || m.Name != sqlite[i].Name || m.Down == "" {
+				t.Fatalf("%s: unexpected migration %d_%s", dialect, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func openTestDb(t *testing.T) *gorm.DB {
+	db, err := database.Open(database.Config{Driver: database.Sqlite3, Path: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUpDown(t *testing.T) {
+	db := openTestDb(t)
+	all, _ := All("sqlite3")
+	if err := Check(db); err != ErrSchemaBehind {
+		t.Fatalf("expected %v on an empty database, got %v", ErrSchemaBehind, err)
+	}
+
+	if done, err := Up(db, 0); err != nil || len(done) != len(all) {
+		t.Fatalf("expected the %d migrations to be applied, got %d: %v", len(all), len(done), err)
+	}
+	if err := Check(db); err != nil {
+		t.Fatalf("expected the schema to be up to date: %s", err)
+	}
+	if done, err := Up(db, 0); err != nil || len(done) != 0 {
+		t.Fatalf("expected nothing to apply, got %d: %v", len(done), err)
+	}
+
+	// a pending migration is refused
+	if done, err := Down(db, 1); err != nil || len(done) != 1 || done[0].Version != all[len(all)-1].Version {
+		t.Fatalf("expected the last migration to be reverted, got %v: %v", done, err)
+	}
+	if err := Check(db); err != ErrSchemaBehind {
+		t.Fatalf("expected %v with a pending migration, got %v", ErrSchemaBehind, err)
+	}
+
+	if done, err := Down(db, len(all)); err != nil || len(done) != len(all)-1 {
+		t.Fatalf("expected every migration to be reverted, got %d: %v", len(done), err)
+	}
+	if db.HasTable("users") {
+		t.Fatalf("expected the users table to be dropped")
+	}
+
+	if done, err := Up(db, 2); err != nil || len(done) != 2 {
+		t.Fatalf("expected 2 migrations to be applied, got %d: %v", len(done), err)
+	}
+	if done, err := Up(db, 0); err != nil || len(done) != len(all)-2 {
+		t.Fatalf("expected the other migrations to be applied, got %d: %v", len(done), err)
+	}
+	if err := Check(db); err != nil {
+		t.Fatalf("expected the schema to be up to date: %s", err)
+	}
+}
+
+func TestModified(t *testing.T) {
+	db := openTestDb(t)
+	if _, err := Up(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&SchemaMigration{}).Where("version = ?", 1).Update("checksum", "other").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(db); err == nil || err == ErrSchemaBehind {
+		t.Fatalf("expected a modified migration to be reported, got %v", err)
+	}
+	if _, err := Up(db, 0); err == nil {
+		t.Fatalf("expected up to refuse a modified migration")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	for _, dialect := range Dialects {
+		os.Mkdir(filepath.Join(dir, dialect), 0755)
+	}
+	os.WriteFile(filepath.Join(dir, "postgres", "3_a.up.sql"), []byte("A;"), 0644)
+
+	paths, err := Create(dir, "add_b")
+	if err != nil || len(paths) != 2*len(Dialects) {
+		t.Fatalf("expected the files of every dialect: %v %v", paths, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sqlite3", "4_add_b.down.sql")); err != nil {
+		t.Fatalf("expected the next version of every dialect: %s", err)
+	}
+	if _, err := Create(dir, "add-c"); err == nil {
+		t.Fatalf("expected an invalid name to fail")
+	}
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS counters
+(
+  name       VARCHAR(128) NOT NULL,
+  value      BIGINT       NOT NULL,
+  expires_at DATETIME     NOT NULL,
+  PRIMARY KEY (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE INDEX counters_expires_at ON counters (expires_at);
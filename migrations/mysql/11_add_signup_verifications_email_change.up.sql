@@ -0,0 +1 @@
+ALTER TABLE user_signup_verifications ADD COLUMN email_change BOOLEAN NOT NULL DEFAULT FALSE;
@@ -1,5 +1,3 @@
-USE babakoto;
-
 CREATE TABLE IF NOT EXISTS users
 (
   id                  VARCHAR(36)                                                     NOT NULL,
@@ -17,7 +15,8 @@ CREATE TABLE IF NOT EXISTS access_tokens
   user_id    VARCHAR(36)                        NOT NULL,
   ttl        INTEGER                            NOT NULL,
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
-  PRIMARY KEY (id)
+  PRIMARY KEY (id),
+  FOREIGN KEY (user_id) REFERENCES users (id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 CREATE TABLE IF NOT EXISTS user_signup_verifications
@@ -28,8 +27,3 @@ CREATE TABLE IF NOT EXISTS user_signup_verifications
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
   PRIMARY KEY(id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
-
-ALTER TABLE access_tokens
-      ADD FOREIGN KEY (user_id) REFERENCES users (id);
-
-
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS external_identities
+(
+  id         VARCHAR(36)                        NOT NULL,
+  user_id    VARCHAR(36)                        NOT NULL,
+  issuer     VARCHAR(255)                       NOT NULL,
+  subject    VARCHAR(255)                       NOT NULL,
+  email      VARCHAR(512)                       NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY (issuer, subject),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_permissions
+(
+  id         VARCHAR(36)                        NOT NULL,
+  user_id    VARCHAR(36)                        NOT NULL,
+  permission VARCHAR(64)                        NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY (user_id, permission),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
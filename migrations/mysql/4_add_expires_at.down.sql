@@ -0,0 +1,2 @@
+ALTER TABLE user_signup_verifications DROP COLUMN expires_at;
+ALTER TABLE access_tokens DROP COLUMN expires_at;
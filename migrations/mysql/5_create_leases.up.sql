@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS leases
+(
+  name       VARCHAR(64)  NOT NULL,
+  holder     VARCHAR(255) NOT NULL,
+  expires_at DATETIME     NOT NULL,
+  PRIMARY KEY (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
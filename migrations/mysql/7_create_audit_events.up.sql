@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+  id         VARCHAR(36)  NOT NULL,
+  action     VARCHAR(64)  NOT NULL,
+  actor_id   VARCHAR(36)  NOT NULL,
+  user_id    VARCHAR(36)  NOT NULL,
+  request_id VARCHAR(64)  NOT NULL,
+  created_at DATETIME     NOT NULL,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE INDEX audit_events_created_at ON audit_events (created_at, id);
+CREATE INDEX audit_events_user_id ON audit_events (user_id, created_at);
@@ -0,0 +1,4 @@
+ALTER TABLE external_identities MODIFY email VARCHAR(512) NOT NULL;
+DROP INDEX users_email_index ON users;
+ALTER TABLE users DROP COLUMN email_index;
+ALTER TABLE users MODIFY email VARCHAR(512) NOT NULL;
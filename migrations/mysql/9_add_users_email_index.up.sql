@@ -0,0 +1,4 @@
+ALTER TABLE users MODIFY email VARCHAR(1024) NOT NULL;
+ALTER TABLE users ADD COLUMN email_index VARCHAR(64) NULL DEFAULT NULL;
+CREATE INDEX users_email_index ON users (email_index);
+ALTER TABLE external_identities MODIFY email VARCHAR(1024) NOT NULL;
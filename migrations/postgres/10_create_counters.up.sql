@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS counters
+(
+  name       VARCHAR(128) NOT NULL,
+  value      BIGINT       NOT NULL,
+  expires_at TIMESTAMP    NOT NULL,
+  PRIMARY KEY (name)
+);
+CREATE INDEX IF NOT EXISTS counters_expires_at ON counters (expires_at);
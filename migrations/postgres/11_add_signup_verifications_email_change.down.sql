@@ -0,0 +1 @@
+ALTER TABLE user_signup_verifications DROP COLUMN IF EXISTS email_change;
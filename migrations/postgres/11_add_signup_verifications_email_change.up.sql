@@ -0,0 +1 @@
+ALTER TABLE user_signup_verifications ADD COLUMN IF NOT EXISTS email_change BOOLEAN NOT NULL DEFAULT FALSE;
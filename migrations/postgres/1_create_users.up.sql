@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS users
+(
+  id                  VARCHAR(36)                         NOT NULL,
+  username            VARCHAR(512)                        NOT NULL,
+  email               VARCHAR(512)                        NOT NULL,
+  password            VARCHAR(512)                        NOT NULL,
+  created_at          TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at          TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS access_tokens
+(
+  id         VARCHAR(36)                         NOT NULL,
+  user_id    VARCHAR(36)                         NOT NULL,
+  ttl        INTEGER                             NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_signup_verifications
+(
+  id         VARCHAR(36)                         NOT NULL,
+  user_id    VARCHAR(36)                         NOT NULL,
+  ttl        INTEGER                             NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY(id)
+);
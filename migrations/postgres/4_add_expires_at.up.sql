@@ -0,0 +1,7 @@
+ALTER TABLE access_tokens ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL;
+UPDATE access_tokens SET expires_at = created_at + ttl * INTERVAL '1 second';
+CREATE INDEX IF NOT EXISTS access_tokens_expires_at ON access_tokens (expires_at);
+
+ALTER TABLE user_signup_verifications ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL;
+UPDATE user_signup_verifications SET expires_at = created_at + ttl * INTERVAL '1 second';
+CREATE INDEX IF NOT EXISTS user_signup_verifications_expires_at ON user_signup_verifications (expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_deleted_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,4 @@
+ALTER TABLE external_identities ALTER COLUMN email TYPE VARCHAR(512);
+DROP INDEX IF EXISTS users_email_index;
+ALTER TABLE users DROP COLUMN IF EXISTS email_index;
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(512);
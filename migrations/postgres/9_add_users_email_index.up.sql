@@ -0,0 +1,4 @@
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(1024);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_index VARCHAR(64) NULL DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS users_email_index ON users (email_index);
+ALTER TABLE external_identities ALTER COLUMN email TYPE VARCHAR(1024);
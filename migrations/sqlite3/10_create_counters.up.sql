@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS counters
+(
+  name       TEXT     NOT NULL,
+  value      INTEGER  NOT NULL,
+  expires_at DATETIME NOT NULL,
+  PRIMARY KEY (name)
+);
+CREATE INDEX IF NOT EXISTS counters_expires_at ON counters (expires_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_signup_verifications;
+DROP TABLE IF EXISTS access_tokens;
+DROP TABLE IF EXISTS users;
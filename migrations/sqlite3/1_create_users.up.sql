@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS users
+(
+  id                  TEXT                               NOT NULL,
+  username            TEXT                               NOT NULL,
+  email               TEXT                               NOT NULL,
+  password            TEXT                               NOT NULL,
+  created_at          DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at          DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS access_tokens
+(
+  id         TEXT                               NOT NULL,
+  user_id    TEXT                               NOT NULL,
+  ttl        INTEGER                            NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_signup_verifications
+(
+  id         TEXT                               NOT NULL,
+  user_id    TEXT                               NOT NULL,
+  ttl        INTEGER                            NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY(id)
+);
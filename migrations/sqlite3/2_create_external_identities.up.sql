@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS external_identities
+(
+  id         TEXT                               NOT NULL,
+  user_id    TEXT                               NOT NULL,
+  issuer     TEXT                               NOT NULL,
+  subject    TEXT                               NOT NULL,
+  email      TEXT                               NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE (issuer, subject),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_permissions
+(
+  id         TEXT                               NOT NULL,
+  user_id    TEXT                               NOT NULL,
+  permission TEXT                               NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE (user_id, permission),
+  FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS user_signup_verifications_expires_at;
+ALTER TABLE user_signup_verifications DROP COLUMN expires_at;
+DROP INDEX IF EXISTS access_tokens_expires_at;
+ALTER TABLE access_tokens DROP COLUMN expires_at;
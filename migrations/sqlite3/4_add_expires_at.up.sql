@@ -0,0 +1,8 @@
+-- sqlite only accept a constant default when adding a column
+ALTER TABLE access_tokens ADD COLUMN expires_at DATETIME DEFAULT '1970-01-01 00:00:00' NOT NULL;
+UPDATE access_tokens SET expires_at = datetime(created_at, '+' || ttl || ' seconds');
+CREATE INDEX IF NOT EXISTS access_tokens_expires_at ON access_tokens (expires_at);
+
+ALTER TABLE user_signup_verifications ADD COLUMN expires_at DATETIME DEFAULT '1970-01-01 00:00:00' NOT NULL;
+UPDATE user_signup_verifications SET expires_at = datetime(created_at, '+' || ttl || ' seconds');
+CREATE INDEX IF NOT EXISTS user_signup_verifications_expires_at ON user_signup_verifications (expires_at);
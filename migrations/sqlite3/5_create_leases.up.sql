@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS leases
+(
+  name       TEXT     NOT NULL,
+  holder     TEXT     NOT NULL,
+  expires_at DATETIME NOT NULL,
+  PRIMARY KEY (name)
+);
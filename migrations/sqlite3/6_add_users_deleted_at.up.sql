@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN deleted_at DATETIME NULL DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS users_deleted_at ON users (deleted_at);
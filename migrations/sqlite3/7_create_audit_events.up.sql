@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+  id         TEXT     NOT NULL,
+  action     TEXT     NOT NULL,
+  actor_id   TEXT     NOT NULL,
+  user_id    TEXT     NOT NULL,
+  request_id TEXT     NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS audit_events_created_at ON audit_events (created_at, id);
+CREATE INDEX IF NOT EXISTS audit_events_user_id ON audit_events (user_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN email_index TEXT NULL DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS users_email_index ON users (email_index);
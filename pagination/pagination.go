@@ -0,0 +1,251 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/jsend"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// filter operators
+const (
+	Eq  = "="
+	Gte = ">="
+	Lt  = "<"
+)
+
+// Filter is a column which can be filtered with a query parameter
+type Filter struct {
+	Column string
+	// Eq if empty
+	Op string
+	// the value must be a RFC 3339 time
+	Time bool
+}
+
+// Spec whitelist how a list can be sorted and filtered, the names are the
+// ones used in the query string
+type Spec struct {
+	// break the ties of the sort so the order is stable, must be unique
+	IdColumn string
+	Sorts    map[string]string
+	// name of the sort used by default, prefixed with - to sort descending
+	DefaultSort string
+	Filters     map[string]Filter
+}
+
+type Condition struct {
+	Column string
+	Op     string
+	Value  interface{}
+}
+
+// Page is a parsed list request
+type Page struct {
+	Limit int
+	// name and column of the sort
+	Sort       string
+	SortColumn string
+	Desc       bool
+	IdColumn   string
+	Conditions []Condition
+	// position after which the page start, nil for the first page
+	Cursor *Cursor
+}
+
+// Cursor is the position of the last item of a page, sent to the clients as
+// an opaque string. It does not hold the id of the item, some ids are
+// secrets (the access tokens), the items with the same sort value are
+// skipped instead.
+type Cursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	// the sort value of the last item, Kind tell how to decode it
+	Kind  string `json:"k"`
+	Value string `json:"v"`
+	// how many items with this sort value were already returned
+	Skip int `json:"n,omitempty"`
+}
+
+// Error is a bad list request, Param is the faulty query parameter
+type Error struct {
+	Param   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Param, e.Message)
+}
+
+// Fail is the jsend body of the error, to send with a 400
+func (e *Error) Fail() map[string]interface{} {
+	return jsend.FailWithName(e.Message, e.Param)
+}
+
+// Parse read the limit, sort, cursor and filter parameters of query
+func Parse(query url.Values, spec Spec) (Page, *Error) {
+	page := Page{Limit: DefaultLimit, IdColumn: spec.IdColumn}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return page, &Error{"limit", "must be a positive integer"}
+		}
+		// clamp rather than fail, clients can ask for everything
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		page.Limit = limit
+	}
+
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = spec.DefaultSort
+	}
+	page.Desc = strings.HasPrefix(sortName, "-")
+	page.Sort = strings.TrimPrefix(sortName, "-")
+	column, ok := spec.Sorts[page.Sort]
+	if !ok {
+		return page, &Error{"sort", "cannot sort by " + page.Sort}
+	}
+	page.SortColumn = column
+
+	if raw := query.Get("cursor"); raw != "" {
+		c, err := decode(raw)
+		if err != nil {
+			return page, &Error{"cursor", "invalid cursor"}
+		}
+		if c.Sort != page.Sort || c.Desc != page.Desc {
+			return page, &Error{"cursor", "the cursor was made for another sort"}
+		}
+		page.Cursor = &c
+	}
+
+	// sorted so the conditions are always in the same order
+	names := []string{}
+	for name := range spec.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		f := spec.Filters[name]
+		op := f.Op
+		if op == "" {
+			op = Eq
+		}
+		var value interface{} = raw
+		if f.Time {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return page, &Error{name, "must be a RFC 3339 time"}
+			}
+			value = t.UTC()
+		}
+		page.Conditions = append(page.Conditions, Condition{f.Column, op, value})
+	}
+	return page, nil
+}
+
+// With add a condition which is not given by the client, e.g the owner
+func (p Page) With(column string, value interface{}) Page {
+	p.Conditions = append(append([]Condition{}, p.Conditions...), Condition{column, Eq, value})
+	return p
+}
+
+func decode(raw string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if c.Skip < 0 {
+		return c, fmt.Errorf("negative skip")
+	}
+	_, err = c.arg()
+	return c, err
+}
+
+func (c Cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// arg is the sort value of the cursor as a query argument
+func (c Cursor) arg() (interface{}, error) {
+	switch c.Kind {
+	case "time":
+		return time.Parse(time.RFC3339Nano, c.Value)
+	case "int":
+		return strconv.ParseInt(c.Value, 10, 64)
+	case "string":
+		return c.Value, nil
+	}
+	return nil, fmt.Errorf("unknown cursor kind %s", c.Kind)
+}
+
+func (p Page) cursorAt(value interface{}, skip int) string {
+	c := Cursor{Sort: p.Sort, Desc: p.Desc, Skip: skip}
+	switch v := value.(type) {
+	case time.Time:
+		c.Kind, c.Value = "time", v.UTC().Format(time.RFC3339Nano)
+	case int:
+		c.Kind, c.Value = "int", strconv.Itoa(v)
+	case int64:
+		c.Kind, c.Value = "int", strconv.FormatInt(v, 10)
+	default:
+		c.Kind, c.Value = "string", fmt.Sprint(v)
+	}
+	return c.encode()
+}
+
+// Next return how many of the n fetched items belong to the page and the
+// cursor of the next page, empty if it is the last one. The queries fetch
+// one more item than the limit to know if there is a next page. value
+// return the column of the i-th item.
+func (p Page) Next(n int, value func(i int, column string) interface{}) (int, string) {
+	if n <= p.Limit {
+		return n, ""
+	}
+	last := value(p.Limit-1, p.SortColumn)
+	skip := 0
+	for i := p.Limit - 1; i >= 0 && compare(value(i, p.SortColumn), last) == 0; i-- {
+		skip++
+	}
+	// the whole page has the value of the cursor, skip it too next time
+	if skip == p.Limit && p.Cursor != nil {
+		if arg, _ := p.Cursor.arg(); compare(last, arg) == 0 {
+			skip += p.Cursor.Skip
+		}
+	}
+	return p.Limit, p.cursorAt(last, skip)
+}
+
+// Response is the jsend envelope of a page, the items are under name
+func Response(name string, items interface{}, nextCursor string) map[string]interface{} {
+	data := map[string]interface{}{}
+	data[name] = items
+	if nextCursor != "" {
+		data["next_cursor"] = nextCursor
+	} else {
+		data["next_cursor"] = nil
+	}
+	return jsend.New(data)
+}
@@ -0,0 +1,180 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	id      string
+	rank    int
+	name    string
+	created time.Time
+}
+
+var testSpec = Spec{
+	IdColumn:    "id",
+	Sorts:       map[string]string{"rank": "rank", "created": "created"},
+	DefaultSort: "rank",
+	Filters: map[string]Filter{
+		"name":          {Column: "name"},
+		"created_after": {Column: "created", Op: Gte, Time: true},
+	},
+}
+
+func testItems() []testItem {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// ties on the rank, one of them larger than a page
+	ranks := []int{3, 1, 2, 2, 2, 2, 1, 3, 2, 4}
+	items := []testItem{}
+	for i, rank := range ranks {
+		items = append(items, testItem{
+			id:      string(rune('a' + i)),
+			rank:    rank,
+			name:    []string{"alice", "bob"}[i%2],
+			created: t0.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	return items
+}
+
+func itemValue(items []testItem) func(i int, column string) interface{} {
+	return func(i int, column string) interface{} {
+		switch column {
+		case "rank":
+			return items[i].rank
+		case "name":
+			return items[i].name
+		case "created":
+			return items[i].created
+		}
+		return items[i].id
+	}
+}
+
+// walk fetch every page of query and return the ids in order
+func walk(t *testing.T, items []testItem, query url.Values) []string {
+	ids := []string{}
+	value := itemValue(items)
+	for pages := 0; ; pages++ {
+		if pages > len(items) {
+			t.Fatalf("the pages never end, got %v", ids)
+		}
+		page, perr := Parse(query, testSpec)
+		if perr != nil {
+			t.Fatal(perr)
+		}
+		keep := page.Select(len(items), value)
+		n, next := page.Next(len(keep), func(i int, column string) interface{} {
+			return value(keep[i], column)
+		})
+		for _, i := range keep[:n] {
+			ids = append(ids, items[i].id)
+		}
+		if next == "" {
+			return ids
+		}
+		query.Set("cursor", next)
+	}
+}
+
+func TestWalkTies(t *testing.T) {
+	items := testItems()
+	for _, c := range []struct {
+		query    string
+		expected string
+	}{
+		// the ties are ordered by id
+		{"", "bgcdefiahj"},
+		{"limit=3", "bgcdefiahj"},
+		{"limit=2", "bgcdefiahj"},
+		{"limit=1", "bgcdefiahj"},
+		{"limit=3&sort=-rank", "jhaifedcgb"},
+		{"limit=4&sort=-created", "jihgfedcba"},
+		{"limit=2&name=alice", "gceia"},
+		{"limit=3&created_after=2020-01-01T05:00:00Z", "gfihj"},
+	} {
+		query, _ := url.ParseQuery(c.query)
+		if ids := strings.Join(walk(t, items, query), ""); ids != c.expected {
+			t.Fatalf("%q: expected %s, got %s", c.query, c.expected, ids)
+		}
+	}
+}
+
+func TestLastPage(t *testing.T) {
+	items := testItems()
+	page, _ := Parse(url.Values{"limit": {"10"}}, testSpec)
+	keep := page.Select(len(items), itemValue(items))
+	n, next := page.Next(len(keep), func(i int, column string) interface{} {
+		return itemValue(items)(keep[i], column)
+	})
+	if n != 10 || next != "" {
+		t.Fatalf("expected a single page without cursor, got %d %q", n, next)
+	}
+	// one more item than the limit is fetched to know there is a next page
+	page, _ = Parse(url.Values{"limit": {"9"}}, testSpec)
+	if keep := page.Select(len(items), itemValue(items)); len(keep) != 10 {
+		t.Fatalf("expected limit + 1 items, got %d", len(keep))
+	}
+	if r := Response("items", []string{}, ""); r["data"].(map[string]interface{})["next_cursor"] != nil {
+		t.Fatalf("expected a null next_cursor, got %v", r)
+	}
+}
+
+func TestParse(t *testing.T) {
+	page, perr := Parse(url.Values{"limit": {"1000"}, "password": {"x"}, "name": {"alice"}}, testSpec)
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	if page.Limit != MaxLimit || page.Sort != "rank" || page.Desc {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	// only the filters of the spec become conditions
+	if len(page.Conditions) != 1 || page.Conditions[0] != (Condition{"name", Eq, "alice"}) {
+		t.Fatalf("unexpected conditions %+v", page.Conditions)
+	}
+
+	for _, c := range []struct {
+		query string
+		param string
+	}{
+		{"limit=0", "limit"},
+		{"limit=ten", "limit"},
+		{"sort=password", "sort"},
+		{"sort=-password", "sort"},
+		{"created_after=yesterday", "created_after"},
+	} {
+		query, _ := url.ParseQuery(c.query)
+		if _, perr := Parse(query, testSpec); perr == nil || perr.Param != c.param {
+			t.Fatalf("%s: expected an error on %s, got %v", c.query, c.param, perr)
+		}
+	}
+}
+
+func TestInvalidCursor(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	valid := Page{Sort: "rank"}.cursorAt(2, 1)
+	if _, perr := Parse(url.Values{"cursor": {valid}}, testSpec); perr != nil {
+		t.Fatalf("expected the cursor to be valid: %v", perr)
+	}
+	for name, cursor := range map[string]string{
+		"not base64":    "%%%",
+		"not json":      encode("rank"),
+		"unknown kind":  encode(`{"s":"rank","k":"float","v":"1.5"}`),
+		"tampered int":  encode(`{"s":"rank","k":"int","v":"1 OR 1=1"}`),
+		"tampered time": encode(`{"s":"created","k":"time","v":"yesterday"}`),
+		"negative skip": encode(`{"s":"rank","k":"int","v":"2","n":-1}`),
+		"other sort":    Page{Sort: "created"}.cursorAt(time.Now(), 0),
+		"other order":   Page{Sort: "rank", Desc: true}.cursorAt(2, 0),
+	} {
+		_, perr := Parse(url.Values{"cursor": {cursor}}, testSpec)
+		if perr == nil || perr.Param != "cursor" {
+			t.Fatalf("%s: expected an error on the cursor, got %v", name, perr)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package pagination
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Apply add the conditions, the cursor, the order and the limit of the page
+// to db, the columns come from the Spec so they are safe to format
+func (p Page) Apply(db *gorm.DB) *gorm.DB {
+	for _, c := range p.Conditions {
+		db = db.Where(fmt.Sprintf("%s %s ?", c.Column, c.Op), c.Value)
+	}
+	dir, cmp := "ASC", ">="
+	if p.Desc {
+		dir, cmp = "DESC", "<="
+	}
+	db = db.Order(p.SortColumn + " " + dir).Order(p.IdColumn + " " + dir).Limit(p.Limit + 1)
+	if p.Cursor != nil {
+		// checked by Parse
+		value, _ := p.Cursor.arg()
+		// the items with the value of the cursor come first, skip the ones
+		// already returned
+		db = db.Where(fmt.Sprintf("%s %s ?", p.SortColumn, cmp), value).Offset(p.Cursor.Skip)
+	}
+	return db
+}
+
+// Select is Apply for the stores without query language, it return the
+// indexes of the n items to fetch in the order of the page
+func (p Page) Select(n int, value func(i int, column string) interface{}) []int {
+	keep := []int{}
+	for i := 0; i < n; i++ {
+		if p.match(i, value) {
+			keep = append(keep, i)
+		}
+	}
+	sort.SliceStable(keep, func(a, b int) bool {
+		return p.before(value(keep[a], p.SortColumn), fmt.Sprint(value(keep[a], p.IdColumn)),
+			value(keep[b], p.SortColumn), fmt.Sprint(value(keep[b], p.IdColumn)))
+	})
+	if p.Cursor != nil {
+		if p.Cursor.Skip >= len(keep) {
+			return nil
+		}
+		keep = keep[p.Cursor.Skip:]
+	}
+	if len(keep) > p.Limit+1 {
+		keep = keep[:p.Limit+1]
+	}
+	return keep
+}
+
+func (p Page) match(i int, value func(i int, column string) interface{}) bool {
+	for _, c := range p.Conditions {
+		cmp := compare(value(i, c.Column), c.Value)
+		switch {
+		case c.Op == Eq && cmp != 0,
+			c.Op == Gte && cmp < 0,
+			c.Op == Lt && cmp >= 0:
+			return false
+		}
+	}
+	if p.Cursor != nil {
+		arg, _ := p.Cursor.arg()
+		cmp := compare(value(i, p.SortColumn), arg)
+		return cmp == 0 || (cmp > 0) != p.Desc
+	}
+	return true
+}
+
+// before tell if the item a come before b in the page
+func (p Page) before(a interface{}, aId string, b interface{}, bId string) bool {
+	cmp := compare(a, b)
+	if cmp == 0 {
+		cmp = strings.Compare(aId, bId)
+	}
+	if p.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		b, _ := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	case int:
+		return compareInt(int64(a), b)
+	case int64:
+		return compareInt(a, b)
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareInt(a int64, b interface{}) int {
+	var v int64
+	switch b := b.(type) {
+	case int:
+		v = int64(b)
+	case int64:
+		v = b
+	}
+	switch {
+	case a < v:
+		return -1
+	case a > v:
+		return 1
+	}
+	return 0
+}
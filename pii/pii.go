@@ -0,0 +1,195 @@
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// prefix of the encrypted values, followed by the key id
+const prefix = "enc:"
+
+// nonce + data key + tag
+const wrappedKeySize = 12 + 32 + 16
+
+type Config struct {
+	// id of the key used to encrypt, the other keys only decrypt the values
+	// not re-encrypted yet
+	CurrentKey string `json:"current_key"`
+	// base64 of 32 bytes keys by id
+	Keys map[string]string `json:"keys"`
+	// base64 key of the blind indexes, changing it need to reindex
+	IndexKey string `json:"index_key"`
+	// json file with the fields above, to keep the keys out of the
+	// configuration
+	KeyFile string `json:"key_file"`
+}
+
+// Cipher encrypt the personal data before it is stored. A nil Cipher keep
+// the values in clear.
+type Cipher struct {
+	current  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// Load return the cipher of the configuration, nil if no key is configured
+func Load(c Config) (*Cipher, error) {
+	if c.KeyFile != "" {
+		raw, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file: %s", err.Error())
+		}
+		c = Config{}
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, fmt.Errorf("invalid key file: %s", err.Error())
+		}
+	}
+	if len(c.Keys) == 0 {
+		return nil, nil
+	}
+
+	ci := &Cipher{current: c.CurrentKey, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range c.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", id, err.Error())
+		}
+		if ci.keys[id], err = newAead(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ci.keys[c.CurrentKey]; !ok {
+		return nil, fmt.Errorf("current_key %q is not in the keys", c.CurrentKey)
+	}
+	var err error
+	if ci.indexKey, err = decodeKey(c.IndexKey); err != nil {
+		return nil, fmt.Errorf("index_key: %s", err.Error())
+	}
+	return ci, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("must be base64")
+	}
+	if len(key) != 32 {
+		return nil, errors.New("must be 32 bytes")
+	}
+	return key, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, column []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("[pii.seal] no randomness: %s", err.Error()))
+	}
+	return aead.Seal(nonce, nonce, plain, column)
+}
+
+func open(aead cipher.AEAD, sealed, column []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated value")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], column)
+}
+
+// Encrypt value with a new data key, itself encrypted with the current key.
+// The column is authenticated so a value cannot be moved to another one.
+func (c *Cipher) Encrypt(column, value string) (string, error) {
+	if c == nil {
+		return value, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	data, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed := seal(c.keys[c.current], dataKey, []byte(column))
+	sealed = append(sealed, seal(data, []byte(value), []byte(column))...)
+	return prefix + c.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value of column, the values stored before the encryption was
+// enabled are returned as is
+func (c *Cipher) Decrypt(column, value string) (string, error) {
+	id := KeyId(value)
+	if id == "" {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("encrypted value but no key configured")
+	}
+	master, ok := c.keys[id]
+	if !ok {
+		return "", fmt.Errorf("unknown key %s", id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(value[len(prefix)+len(id)+1:])
+	if err != nil || len(sealed) < wrappedKeySize {
+		return "", errors.New("malformed value")
+	}
+	dataKey, err := open(master, sealed[:wrappedKeySize], []byte(column))
+	if err != nil {
+		return "", err
+	}
+	data, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(data, sealed[wrappedKeySize:], []byte(column))
+	return string(plain), err
+}
+
+// KeyId return the id of the key which encrypted value, empty if the value
+// is in clear
+func KeyId(value string) string {
+	if !strings.HasPrefix(value, prefix) {
+		return ""
+	}
+	rest := value[len(prefix):]
+	if i := strings.Index(rest, ":"); i > 0 {
+		return rest[:i]
+	}
+	return ""
+}
+
+// Stale tell if value must be encrypted again with the current key
+func (c *Cipher) Stale(value string) bool {
+	return c != nil && KeyId(value) != c.current
+}
+
+// Index return the blind index of value, the same value always give the same
+// index so it can be searched without being decrypted
+func (c *Cipher) Index(value string) string {
+	if c == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
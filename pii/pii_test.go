@@ -0,0 +1,152 @@
+package pii
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), 32)))
+}
+
+func newTestCipher(t *testing.T, current string) *Cipher {
+	c, err := Load(Config{
+		CurrentKey: current,
+		Keys:       map[string]string{"k1": testKey(1), "k2": testKey(2)},
+		IndexKey:   testKey(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newTestCipher(t, "k1")
+	enc, err := c.Encrypt("users.email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enc, "enc:k1:") || strings.Contains(enc, "alice") {
+		t.Fatalf("unexpected encrypted value %s", enc)
+	}
+	if plain, err := c.Decrypt("users.email", enc); err != nil || plain != "alice@example.com" {
+		t.Fatalf("expected the email back: %q %v", plain, err)
+	}
+	// each value has its own data key and nonce
+	if other, _ := c.Encrypt("users.email", "alice@example.com"); other == enc {
+		t.Fatalf("expected two encryptions to differ")
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	c := newTestCipher(t, "k1")
+	enc, _ := c.Encrypt("users.email", "alice@example.com")
+	tampered := []byte(enc)
+	tampered[len(tampered)-5] ^= 1
+
+	// the column is authenticated, the value cannot be moved
+	if _, err := c.Decrypt("external_identities.email", enc); err == nil {
+		t.Fatalf("expected another column to fail")
+	}
+	for name, value := range map[string]string{
+		"unknown key": "enc:k9:" + strings.TrimPrefix(enc, "enc:k1:"),
+		"wrong key":   "enc:k2:" + strings.TrimPrefix(enc, "enc:k1:"),
+		"tampered":    string(tampered),
+		"truncated":   enc[:20],
+		"not base64":  "enc:k1:***",
+	} {
+		if _, err := c.Decrypt("users.email", value); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+	var none *Cipher
+	if _, err := none.Decrypt("users.email", enc); err == nil {
+		t.Fatalf("expected an error without key")
+	}
+}
+
+func TestClearValues(t *testing.T) {
+	c := newTestCipher(t, "k1")
+	// stored before the encryption was enabled
+	if plain, err := c.Decrypt("users.email", "alice@example.com"); err != nil || plain != "alice@example.com" {
+		t.Fatalf("expected the clear value as is: %q %v", plain, err)
+	}
+	var none *Cipher
+	if enc, _ := none.Encrypt("users.email", "alice@example.com"); enc != "alice@example.com" {
+		t.Fatalf("expected a nil cipher to keep the value in clear, got %s", enc)
+	}
+	if none.Index("alice@example.com") != "" || none.Stale("alice@example.com") {
+		t.Fatalf("expected a nil cipher to neither index nor reencrypt")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old := newTestCipher(t, "k1")
+	enc, _ := old.Encrypt("users.email", "alice@example.com")
+	c := newTestCipher(t, "k2")
+
+	if KeyId(enc) != "k1" || KeyId("alice@example.com") != "" || KeyId("enc:") != "" {
+		t.Fatalf("unexpected key ids")
+	}
+	if !c.Stale(enc) || !c.Stale("alice@example.com") {
+		t.Fatalf("expected the old and clear values to be stale")
+	}
+	// the old key still decrypt until everything is encrypted again
+	plain, err := c.Decrypt("users.email", enc)
+	if err != nil || plain != "alice@example.com" {
+		t.Fatalf("expected the old value to decrypt: %q %v", plain, err)
+	}
+	reenc, _ := c.Encrypt("users.email", plain)
+	if c.Stale(reenc) || KeyId(reenc) != "k2" {
+		t.Fatalf("expected %s to use the current key", reenc)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	c := newTestCipher(t, "k1")
+	index := c.Index("alice@example.com")
+	if index == "" || index != newTestCipher(t, "k2").Index("alice@example.com") {
+		t.Fatalf("expected the index to be deterministic and independent of the current key")
+	}
+	if index == c.Index("bob@example.com") {
+		t.Fatalf("expected distinct values to have distinct indexes")
+	}
+	other, _ := Load(Config{CurrentKey: "k1", Keys: map[string]string{"k1": testKey(1)}, IndexKey: testKey(4)})
+	if index == other.Index("alice@example.com") {
+		t.Fatalf("expected the index to depend on the index key")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if c, err := Load(Config{}); c != nil || err != nil {
+		t.Fatalf("expected no cipher without key: %v %v", c, err)
+	}
+	for name, config := range map[string]Config{
+		"unknown current": {CurrentKey: "k2", Keys: map[string]string{"k1": testKey(1)}, IndexKey: testKey(3)},
+		"colon in id":     {CurrentKey: "k:1", Keys: map[string]string{"k:1": testKey(1)}, IndexKey: testKey(3)},
+		"not base64":      {CurrentKey: "k1", Keys: map[string]string{"k1": "***"}, IndexKey: testKey(3)},
+		"short key":       {CurrentKey: "k1", Keys: map[string]string{"k1": "AAAA"}, IndexKey: testKey(3)},
+		"no index key":    {CurrentKey: "k1", Keys: map[string]string{"k1": testKey(1)}},
+	} {
+		if _, err := Load(config); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := `{"current_key": "k1", "keys": {"k1": "` + testKey(1) + `"}, "index_key": "` + testKey(3) + `"}`
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(Config{KeyFile: path})
+	if err != nil || c == nil {
+		t.Fatalf("expected the keys of the file: %v", err)
+	}
+	if c.Index("alice@example.com") != newTestCipher(t, "k1").Index("alice@example.com") {
+		t.Fatalf("expected the index key of the file")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jeremyletang/babakoto_api/config"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/database"
+	"github.com/jeremyletang/babakoto_api/migrations"
+	"github.com/jeremyletang/babakoto_api/pii"
+)
+
+const reencryptUsage = `usage: babakoto_api [--config path] reencrypt
+
+encrypt the emails stored in clear or with another key than pii.current_key,
+run it after enabling the encryption or adding a new key`
+
+const reencryptBatch = 100
+
+// runReencrypt run the reencrypt subcommand and return the exit code, it can
+// run along the server
+func runReencrypt(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, reencryptUsage)
+		return 2
+	}
+
+	config, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if config.Dev {
+		fmt.Fprintln(os.Stderr, "nothing to encrypt in dev mode")
+		return 1
+	}
+	cipher, err := pii.Load(config.Pii)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load the pii keys: %s\n", err.Error())
+		return 1
+	}
+	if cipher == nil {
+		fmt.Fprintln(os.Stderr, "no pii key configured")
+		return 1
+	}
+	db, err := database.Open(config.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to the database: %s\n", err.Error())
+		return 1
+	}
+	defer db.Close()
+	if err := migrations.Check(db); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	users, err := dao.NewUserDao(db, cipher).Reencrypt(reencryptBatch)
+	fmt.Printf("users: %d re-encrypted\n", users)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "users: %s\n", err.Error())
+		return 1
+	}
+	identities, err := dao.NewExternalIdentityDao(db, cipher).Reencrypt(reencryptBatch)
+	fmt.Printf("external identities: %d re-encrypted\n", identities)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "external identities: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
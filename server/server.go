@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultReadTimeout     = 10
+	defaultWriteTimeout    = 30
+	defaultIdleTimeout     = 120
+	defaultMaxHeaderBytes  = 1 << 20
+	defaultShutdownTimeout = 30
+	defaultShutdownDelay   = 5
+)
+
+type TlsConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// timeouts are in seconds, 0 use the default
+type Config struct {
+	Listen         string `json:"listen"`
+	ReadTimeout    int    `json:"read_timeout"`
+	WriteTimeout   int    `json:"write_timeout"`
+	IdleTimeout    int    `json:"idle_timeout"`
+	MaxHeaderBytes int    `json:"max_header_bytes"`
+	// deadline to drain the in flight requests once the shutdown started
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// time left to the orchestrator to see the failing readiness on SIGTERM
+	// before the listener is closed
+	ShutdownDelay int `json:"shutdown_delay"`
+	// plain http if nil
+	Tls *TlsConfig `json:"tls"`
+	// http/2 is only negotiated with tls
+	Http2 bool `json:"http2"`
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+type Server struct {
+	http   *http.Server
+	config Config
+}
+
+func New(c Config, handler http.Handler) (*Server, error) {
+	c.ReadTimeout = orDefault(c.ReadTimeout, defaultReadTimeout)
+	c.WriteTimeout = orDefault(c.WriteTimeout, defaultWriteTimeout)
+	c.IdleTimeout = orDefault(c.IdleTimeout, defaultIdleTimeout)
+	c.MaxHeaderBytes = orDefault(c.MaxHeaderBytes, defaultMaxHeaderBytes)
+	c.ShutdownTimeout = orDefault(c.ShutdownTimeout, defaultShutdownTimeout)
+	c.ShutdownDelay = orDefault(c.ShutdownDelay, defaultShutdownDelay)
+
+	s := &http.Server{
+		Addr:           c.Listen,
+		Handler:        handler,
+		ReadTimeout:    seconds(c.ReadTimeout),
+		WriteTimeout:   seconds(c.WriteTimeout),
+		IdleTimeout:    seconds(c.IdleTimeout),
+		MaxHeaderBytes: c.MaxHeaderBytes,
+	}
+
+	if c.Tls != nil {
+		if c.Tls.CertFile == "" || c.Tls.KeyFile == "" {
+			return nil, errors.New("tls needs a cert_file and a key_file")
+		}
+		reloader, err := newCertReloader(c.Tls.CertFile, c.Tls.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+	if !c.Http2 {
+		// a non nil map disable the automatic http/2 support
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	return &Server{http: s, config: c}, nil
+}
+
+func (s *Server) Config() Config {
+	return s.config
+}
+
+// ListenAndServe return http.ErrServerClosed once Shutdown is called
+func (s *Server) ListenAndServe() error {
+	if s.config.Tls != nil {
+		log.Infof("Starting https server on %s (http2: %v)", s.config.Listen, s.config.Http2)
+		// the certificate comes from TLSConfig.GetCertificate
+		return s.http.ListenAndServeTLS("", "")
+	}
+	log.Infof("Starting http server on %s", s.config.Listen)
+	return s.http.ListenAndServe()
+}
+
+// Shutdown stop accepting connections and wait for the in flight requests
+// until the shutdown timeout
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), seconds(s.config.ShutdownTimeout))
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
+
+// certReloader load the certificate again when one of the files is modified,
+// so renewed certificates are used without restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// last modification of the cert or the key
+func (cr *certReloader) lastModTime() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModTime()
+	if err != nil {
+		return fmt.Errorf("unable to stat tls files: %s", err.Error())
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load tls certificate: %s", err.Error())
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	modTime, err := cr.lastModTime()
+	if err == nil && !modTime.Equal(cr.modTime) {
+		// keep the previous certificate if the new files are not valid,
+		// they may be written in two steps
+		if err := cr.reload(); err != nil {
+			log.Errorf("[server.GetCertificate] unable to reload certificate: %s", err.Error())
+		} else {
+			log.Infof("[server.GetCertificate] certificate %s reloaded", cr.certFile)
+		}
+	}
+	return cr.cert, nil
+}
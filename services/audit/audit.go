@@ -0,0 +1,22 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/satori/go.uuid"
+)
+
+// Record save an audit event for the request in ctx, it is best effort: the
+// action is already done so a failure is only logged
+func Record(ctx context.Context, repos dao.Repositories, action, actorId, userId string) {
+	requestId, _ := ctxext.ExtractRequestId(ctx)
+	e := domain.NewAuditEvent(uuid.NewV4().String(), action, actorId, userId, requestId, time.Now())
+	if err := repos.AuditEvents.Create(e); err != nil {
+		log.Errorf("[audit.Record] unable to record %s of user [id=%s]: %s", action, userId, err.Error())
+	}
+}
@@ -0,0 +1,251 @@
+package authcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/domain"
+	"github.com/jeremyletang/babakoto_api/metrics"
+	"github.com/jeremyletang/babakoto_api/services/user"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	defaultSize = 10000
+	defaultTtl  = 30
+)
+
+// Config of the cache of the access tokens, 0 use the defaults
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// max number of access tokens kept, the least recently used go first
+	Size int `json:"size"`
+	// seconds a token is kept. The changes which are not invalidated (the
+	// janitor, another replica without pub/sub) are seen after it.
+	Ttl int `json:"ttl"`
+}
+
+type item struct {
+	key   string
+	token domain.AccessToken
+	user  domain.User
+	// nil until a route which need it ask
+	verified *bool
+	expires  time.Time
+}
+
+// Cache keep the access tokens resolved by the auth middlewares with their
+// user and his verified state, so the authenticated requests do not query
+// the database. A nil Cache is disabled and always read the repositories.
+type Cache struct {
+	// tell the messages of this cache from the ones of the other replicas
+	id    string
+	size  int
+	ttl   time.Duration
+	bus   PubSub
+	mutex sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	// keys of the tokens of a user
+	byUser map[string]map[string]bool
+	// incremented by each invalidation, what was read from the database
+	// while one happened is not stored
+	gen uint64
+}
+
+// New return the cache of the configuration, nil if disabled. The
+// invalidations are published on bus and the ones received are applied.
+func New(c Config, bus PubSub) *Cache {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Size <= 0 {
+		c.Size = defaultSize
+	}
+	if c.Ttl <= 0 {
+		c.Ttl = defaultTtl
+	}
+	ca := &Cache{
+		id:     uuid.NewV4().String(),
+		size:   c.Size,
+		ttl:    time.Duration(c.Ttl) * time.Second,
+		bus:    bus,
+		lru:    list.New(),
+		items:  map[string]*list.Element{},
+		byUser: map[string]map[string]bool{},
+	}
+	bus.Subscribe(func(m Message) {
+		if m.Origin != ca.id {
+			ca.apply(m)
+		}
+	})
+	return ca
+}
+
+// the tokens are secrets, they are neither kept nor published in clear
+func tokenKey(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAccessTokenAndUser is user.GetAccessTokenAndUser through the cache
+func (c *Cache) GetAccessTokenAndUser(
+	repos dao.Repositories,
+	tokenString string,
+) (domain.AccessToken, domain.User, error) {
+	if c == nil {
+		return user.GetAccessTokenAndUser(repos, tokenString)
+	}
+	key := tokenKey(tokenString)
+	now := time.Now()
+	if it, ok := c.get(key, now); ok {
+		metrics.AuthCacheLookups.WithLabelValues("hit").Inc()
+		if it.token.IsExpired(now) {
+			c.remove(key)
+			return it.token, domain.User{}, auth.ErrExpiredToken
+		}
+		return it.token, it.user, nil
+	}
+	metrics.AuthCacheLookups.WithLabelValues("miss").Inc()
+
+	gen := c.generation()
+	token, u, err := user.GetAccessTokenAndUser(repos, tokenString)
+	if err != nil {
+		return token, u, err
+	}
+	c.put(&item{key: key, token: token, user: u, expires: now.Add(c.ttl)}, gen)
+	return token, u, nil
+}
+
+// IsVerified is user.IsVerified through the cache, for the user of the
+// token tokenString
+func (c *Cache) IsVerified(repos dao.Repositories, tokenString, userId string) (bool, error) {
+	if c == nil {
+		return user.IsVerified(repos, userId)
+	}
+	key := tokenKey(tokenString)
+	if it, ok := c.get(key, time.Now()); ok && it.verified != nil {
+		metrics.AuthCacheLookups.WithLabelValues("hit").Inc()
+		return *it.verified, nil
+	}
+	metrics.AuthCacheLookups.WithLabelValues("miss").Inc()
+
+	gen := c.generation()
+	verified, err := user.IsVerified(repos, userId)
+	if err != nil {
+		return verified, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.items[key]; ok && c.gen == gen {
+		el.Value.(*item).verified = &verified
+	}
+	return verified, nil
+}
+
+// InvalidateToken forget the token, e.g on logout
+func (c *Cache) InvalidateToken(tokenString string) {
+	c.invalidate(Message{TokenKey: tokenKey(tokenString)})
+}
+
+// InvalidateUser forget the tokens of the user, to call once a change of the
+// user or his tokens is committed
+func (c *Cache) InvalidateUser(userId string) {
+	c.invalidate(Message{UserId: userId})
+}
+
+func (c *Cache) invalidate(m Message) {
+	if c == nil {
+		return
+	}
+	m.Origin = c.id
+	c.apply(m)
+	if err := c.bus.Publish(m); err != nil {
+		log.Errorf("[authcache.Cache.invalidate] unable to publish invalidation: %s", err.Error())
+	}
+}
+
+// apply remove what m invalidate, the message can come from this process or
+// from another replica
+func (c *Cache) apply(m Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gen++
+	if m.TokenKey != "" {
+		metrics.AuthCacheInvalidations.WithLabelValues("token").Inc()
+		c.removeLocked(m.TokenKey)
+	}
+	if m.UserId != "" {
+		metrics.AuthCacheInvalidations.WithLabelValues("user").Inc()
+		for key := range c.byUser[m.UserId] {
+			c.removeLocked(key)
+		}
+	}
+}
+
+func (c *Cache) generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.gen
+}
+
+// get return a copy of the item of key if not expired
+func (c *Cache) get(key string, now time.Time) (item, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return item{}, false
+	}
+	it := el.Value.(*item)
+	if now.After(it.expires) {
+		c.removeLocked(key)
+		return item{}, false
+	}
+	c.lru.MoveToFront(el)
+	return *it, true
+}
+
+// put store it unless an invalidation happened since gen
+func (c *Cache) put(it *item, gen uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.removeLocked(it.key)
+	c.items[it.key] = c.lru.PushFront(it)
+	if c.byUser[it.user.Id] == nil {
+		c.byUser[it.user.Id] = map[string]bool{}
+	}
+	c.byUser[it.user.Id][it.key] = true
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back().Value.(*item).key)
+	}
+}
+
+func (c *Cache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *Cache) removeLocked(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	it := el.Value.(*item)
+	c.lru.Remove(el)
+	delete(c.items, key)
+	delete(c.byUser[it.user.Id], key)
+	if len(c.byUser[it.user.Id]) == 0 {
+		delete(c.byUser, it.user.Id)
+	}
+}
@@ -0,0 +1,172 @@
+package authcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+// newTestRepos return repositories with the users alice and bob, each with
+// the tokens given
+func newTestRepos(t *testing.T, tokens map[string]string) dao.Repositories {
+	repos := memory.NewRepositories()
+	for _, id := range []string{"alice", "bob"} {
+		u := domain.User{Id: id, Username: id, Email: id + "@example.com", Version: 1, CreatedAt: time.Now()}
+		if err := repos.Users.Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for token, userId := range tokens {
+		if err := repos.AccessTokens.Create(domain.NewAccessToken(token, userId, 3600, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repos
+}
+
+// cached tell if the token is still served once removed from the repositories
+func cached(c *Cache, repos dao.Repositories, token string) bool {
+	_, _, err := c.GetAccessTokenAndUser(repos, token)
+	return err == nil
+}
+
+func fill(t *testing.T, c *Cache, repos dao.Repositories, tokens ...string) {
+	for _, token := range tokens {
+		if _, _, err := c.GetAccessTokenAndUser(repos, token); err != nil {
+			t.Fatalf("%s: %s", token, err)
+		}
+	}
+}
+
+func revoke(repos dao.Repositories, tokens ...string) {
+	for _, token := range tokens {
+		repos.AccessTokens.Delete(token)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if c := New(Config{}, NewMemoryPubSub()); c != nil {
+		t.Fatalf("expected a nil cache when disabled")
+	}
+	repos := newTestRepos(t, map[string]string{"a1": "alice"})
+	var c *Cache
+	fill(t, c, repos, "a1")
+	revoke(repos, "a1")
+	if _, _, err := c.GetAccessTokenAndUser(repos, "a1"); err != auth.ErrInvalidToken {
+		t.Fatalf("expected the repositories to be read, got %v", err)
+	}
+	c.InvalidateUser("alice")
+}
+
+func TestLruBound(t *testing.T) {
+	repos := newTestRepos(t, map[string]string{"a1": "alice", "a2": "alice", "b1": "bob"})
+	c := New(Config{Enabled: true, Size: 2}, NewMemoryPubSub())
+
+	fill(t, c, repos, "a1", "a2")
+	// a1 is used again, a2 is the least recently used
+	fill(t, c, repos, "a1", "b1")
+	if c.lru.Len() != 2 {
+		t.Fatalf("expected 2 tokens, got %d", c.lru.Len())
+	}
+	revoke(repos, "a1", "a2", "b1")
+	if cached(c, repos, "a2") {
+		t.Fatalf("expected a2 to be evicted")
+	}
+	if !cached(c, repos, "a1") || !cached(c, repos, "b1") {
+		t.Fatalf("expected a1 and b1 to be kept")
+	}
+}
+
+func TestTtl(t *testing.T) {
+	repos := newTestRepos(t, map[string]string{"a1": "alice"})
+	c := New(Config{Enabled: true, Ttl: 1}, NewMemoryPubSub())
+	fill(t, c, repos, "a1")
+	revoke(repos, "a1")
+
+	if _, ok := c.get(tokenKey("a1"), time.Now()); !ok {
+		t.Fatalf("expected a1 to be cached")
+	}
+	if _, ok := c.get(tokenKey("a1"), time.Now().Add(2*time.Second)); ok {
+		t.Fatalf("expected a1 to expire")
+	}
+	if cached(c, repos, "a1") {
+		t.Fatalf("expected the repositories to be read once expired")
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	repos := newTestRepos(t, nil)
+	repos.AccessTokens.Create(domain.NewAccessToken("a1", "alice", 1, time.Now()))
+	c := New(Config{Enabled: true}, NewMemoryPubSub())
+	fill(t, c, repos, "a1")
+
+	// the token expire before the cache entry
+	c.items[tokenKey("a1")].Value.(*item).token.ExpiresAt = time.Now().Add(-time.Second)
+	if _, _, err := c.GetAccessTokenAndUser(repos, "a1"); err != auth.ErrExpiredToken {
+		t.Fatalf("expected %v, got %v", auth.ErrExpiredToken, err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	repos := newTestRepos(t, map[string]string{"a1": "alice", "a2": "alice", "b1": "bob"})
+	c := New(Config{Enabled: true}, NewMemoryPubSub())
+	fill(t, c, repos, "a1", "a2", "b1")
+	if verified, err := c.IsVerified(repos, "a1", "alice"); !verified || err != nil {
+		t.Fatalf("expected alice to be verified: %v", err)
+	}
+	revoke(repos, "a1", "a2", "b1")
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("usv", "alice", 3600, time.Now()))
+
+	// served from the cache until invalidated
+	if verified, _ := c.IsVerified(repos, "a1", "alice"); !verified {
+		t.Fatalf("expected the verified state to be cached")
+	}
+
+	c.InvalidateToken("a1")
+	if cached(c, repos, "a1") {
+		t.Fatalf("expected a1 to be invalidated")
+	}
+	if !cached(c, repos, "a2") {
+		t.Fatalf("expected a2 to be kept")
+	}
+
+	c.InvalidateUser("alice")
+	if cached(c, repos, "a2") {
+		t.Fatalf("expected the tokens of alice to be invalidated")
+	}
+	if !cached(c, repos, "b1") {
+		t.Fatalf("expected the tokens of bob to be kept")
+	}
+	if _, ok := c.byUser["alice"]; ok {
+		t.Fatalf("expected alice to be forgotten")
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	repos := newTestRepos(t, map[string]string{"a1": "alice", "b1": "bob"})
+	bus := NewMemoryPubSub()
+	c1 := New(Config{Enabled: true}, bus)
+	c2 := New(Config{Enabled: true}, bus)
+	var received []Message
+	bus.Subscribe(func(m Message) { received = append(received, m) })
+	fill(t, c1, repos, "a1", "b1")
+	fill(t, c2, repos, "a1", "b1")
+	revoke(repos, "a1", "b1")
+
+	c1.InvalidateUser("alice")
+	c2.InvalidateToken("b1")
+	for _, c := range []*Cache{c1, c2} {
+		if cached(c, repos, "a1") || cached(c, repos, "b1") {
+			t.Fatalf("expected the invalidations to reach every cache")
+		}
+	}
+	// the tokens are not published in clear
+	if len(received) != 2 || received[0].UserId != "alice" || received[1].TokenKey != tokenKey("b1") ||
+		received[0].Origin != c1.id || received[1].Origin != c2.id {
+		t.Fatalf("unexpected messages %+v", received)
+	}
+}
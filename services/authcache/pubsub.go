@@ -0,0 +1,48 @@
+package authcache
+
+import "sync"
+
+// Message is an invalidation, of a token or of every token of a user
+type Message struct {
+	// id of the cache which published it
+	Origin string `json:"origin"`
+	// sha256 of the token
+	TokenKey string `json:"token_key,omitempty"`
+	UserId   string `json:"user_id,omitempty"`
+}
+
+// PubSub carry the invalidations between the replicas of the api, so a
+// logout on one replica is seen by the others. Implement it with a broker to
+// reach the other processes.
+type PubSub interface {
+	Publish(m Message) error
+	// Subscribe register f to receive the messages, the ones published by
+	// this process included
+	Subscribe(f func(m Message))
+}
+
+// MemoryPubSub only reach the subscribers of the process, enough with a
+// single replica
+type MemoryPubSub struct {
+	mutex       sync.RWMutex
+	subscribers []func(m Message)
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{}
+}
+
+func (ps *MemoryPubSub) Publish(m Message) error {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	for _, f := range ps.subscribers {
+		f(m)
+	}
+	return nil
+}
+
+func (ps *MemoryPubSub) Subscribe(f func(m Message)) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.subscribers = append(ps.subscribers, f)
+}
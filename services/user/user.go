@@ -1,61 +1,100 @@
 package user
 
 import (
-	"context"
-	"net/http"
+	"errors"
+	"time"
 
-	"github.com/jeremyletang/babakoto_api/ctxext"
+	"github.com/jeremyletang/babakoto_api/auth"
 	"github.com/jeremyletang/babakoto_api/dao"
 	"github.com/jeremyletang/babakoto_api/domain"
-	"github.com/jeremyletang/babakoto_api/jsend"
-	"github.com/jeremyletang/babakoto_api/utils"
-	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
 )
 
-func AddUserInfoToContext(
-	f func(context.Context, http.ResponseWriter, *http.Request),
-	db *gorm.DB,
-) func(context.Context, http.ResponseWriter, *http.Request) {
-	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		tokenDao := dao.NewAccessTokenDao(db)
-		userDao := dao.NewUserDao(db)
-		signupDao := dao.NewUserSignupVerificationDao(db)
-		var tokenString string
-		var token domain.AccessToken
-		var user domain.User
-		var err error
-		var ok bool
-
-		// get the token string from the context
-		if tokenString, ok = ctxext.ExtractAccessTokenString(ctx); !ok {
-			utils.WriteJsonResponse(w, http.StatusBadRequest,
-				jsend.FailWithName("Missing access token", "access_token"))
-			return
-		}
+// GetAccessTokenAndUser return the access token from its id and the user
+// owning it, or the reason the token cannot be used: an *auth.TokenError,
+// or the dao error if the database failed
+func GetAccessTokenAndUser(
+	repos dao.Repositories,
+	tokenString string,
+) (domain.AccessToken, domain.User, error) {
+	tokenDao := repos.AccessTokens
+	userDao := repos.Users
 
-		// get the token first
-		if token, err = tokenDao.GetById(tokenString); err != nil {
-			utils.WriteJsonResponse(w, http.StatusBadRequest,
-				jsend.FailWithName("Invalid access token", "access_token"))
-		}
+	// get the token first
+	token, err := tokenDao.GetById(tokenString)
+	if errors.Is(err, dao.ErrNotFound) {
+		return token, domain.User{}, auth.ErrInvalidToken
+	} else if err != nil {
+		return token, domain.User{}, err
+	}
 
-		// then get the user from the token userid
-		if user, err = userDao.GetById(token.UserId); err != nil {
-			utils.WriteJsonResponse(w, http.StatusBadRequest,
-				jsend.FailWithName("Invalid access token (no user linked)", "access_token"))
-		}
+	// the token ttl is elapsed
+	if token.IsExpired(time.Now()) {
+		return token, domain.User{}, auth.ErrExpiredToken
+	}
 
-		// then check if the user validated his account, or return failure now
-		if _, err = signupDao.GetByUserId(user.Id); err == nil {
-			utils.WriteJsonResponse(w, http.StatusBadRequest,
-				jsend.FailWithName("Cannot use a non verified user", "access_token"))
-			return
-		}
+	// then get the user from the token userid
+	user, err := userDao.GetById(token.UserId)
+	if errors.Is(err, dao.ErrNotFound) {
+		return token, user, auth.ErrNoUserLinked
+	} else if err != nil {
+		return token, user, err
+	}
+
+	return token, user, nil
+}
 
-		ctx = ctxext.AddUser(ctx, user)
-		ctx = ctxext.AddAccessToken(ctx, token)
+// IsVerified return false while the user has not validated his account
+func IsVerified(repos dao.Repositories, userId string) (bool, error) {
+	signupDao := repos.SignupVerifications
+	_, err := signupDao.GetByUserId(userId)
+	if errors.Is(err, dao.ErrNotFound) {
+		return true, nil
+	}
+	return false, err
+}
 
-		// call the final handler
-		f(ctx, w, r)
+func HasPermission(repos dao.Repositories, userId, permission string) (bool, error) {
+	permissionDao := repos.UserPermissions
+	_, err := permissionDao.GetByUserIdAndPermission(userId, permission)
+	if errors.Is(err, dao.ErrNotFound) {
+		return false, nil
 	}
+	return err == nil, err
+}
+
+// Delete mark the user as deleted and revoke his access tokens, he can be
+// restored until purged
+func Delete(repos dao.Repositories, userId string) error {
+	return repos.WithTx(func(tx dao.Repositories) error {
+		if err := tx.AccessTokens.DeleteByUserId(userId); err != nil {
+			return err
+		}
+		return tx.Users.Delete(userId)
+	})
+}
+
+// Purge remove the user and everything linked to him in a transaction,
+// the foreign keys need the user to be removed last. The audit events are
+// kept, with one more for the purge.
+func Purge(repos dao.Repositories, userId string) error {
+	return repos.WithTx(func(tx dao.Repositories) error {
+		if err := tx.AccessTokens.DeleteByUserId(userId); err != nil {
+			return err
+		}
+		if err := tx.SignupVerifications.DeleteByUserId(userId); err != nil {
+			return err
+		}
+		if err := tx.ExternalIdentities.DeleteByUserId(userId); err != nil {
+			return err
+		}
+		if err := tx.UserPermissions.DeleteByUserId(userId); err != nil {
+			return err
+		}
+		if err := tx.Users.Purge(userId); err != nil {
+			return err
+		}
+		return tx.AuditEvents.Create(domain.NewAuditEvent(uuid.NewV4().String(),
+			domain.AuditUserPurge, "", userId, "", time.Now()))
+	})
 }
@@ -0,0 +1,111 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jeremyletang/babakoto_api/auth"
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/dao/memory"
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+func newTestUser(t *testing.T, repos dao.Repositories, id string) domain.User {
+	u := domain.User{Id: id, Username: id, Email: id + "@example.com", Version: 1, CreatedAt: time.Now()}
+	if err := repos.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestGetAccessTokenAndUser(t *testing.T) {
+	repos := memory.NewRepositories()
+	u := newTestUser(t, repos, "alice")
+	repos.AccessTokens.Create(domain.NewAccessToken("valid", u.Id, 3600, time.Now()))
+	repos.AccessTokens.Create(domain.NewAccessToken("expired", u.Id, 60, time.Now().Add(-time.Hour)))
+	repos.AccessTokens.Create(domain.NewAccessToken("orphan", "nobody", 3600, time.Now()))
+
+	at, found, err := GetAccessTokenAndUser(repos, "valid")
+	if err != nil || at.Id != "valid" || found.Id != u.Id {
+		t.Fatalf("expected the token of alice: %v %v %v", at, found, err)
+	}
+	for token, expected := range map[string]error{
+		"unknown": auth.ErrInvalidToken,
+		"expired": auth.ErrExpiredToken,
+		"orphan":  auth.ErrNoUserLinked,
+	} {
+		if _, _, err := GetAccessTokenAndUser(repos, token); err != expected {
+			t.Fatalf("%s: expected %v, got %v", token, expected, err)
+		}
+	}
+
+	// a deleted user cannot use his tokens
+	repos.Users.Delete(u.Id)
+	if _, _, err := GetAccessTokenAndUser(repos, "valid"); err != auth.ErrNoUserLinked {
+		t.Fatalf("expected %v, got %v", auth.ErrNoUserLinked, err)
+	}
+}
+
+func TestIsVerified(t *testing.T) {
+	repos := memory.NewRepositories()
+	u := newTestUser(t, repos, "alice")
+	if verified, err := IsVerified(repos, u.Id); !verified || err != nil {
+		t.Fatalf("expected verified without verification: %v", err)
+	}
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("usv", u.Id, 3600, time.Now()))
+	if verified, err := IsVerified(repos, u.Id); verified || err != nil {
+		t.Fatalf("expected not verified: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	repos := memory.NewRepositories()
+	u := newTestUser(t, repos, "alice")
+	repos.AccessTokens.Create(domain.NewAccessToken("token", u.Id, 3600, time.Now()))
+
+	if err := Delete(repos, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Users.GetById(u.Id); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the user to be hidden, got %v", err)
+	}
+	if _, err := repos.AccessTokens.GetById("token"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the token to be revoked, got %v", err)
+	}
+	// reserved until purged
+	if used, _ := repos.Users.IsEmailUsed(u.Email); !used {
+		t.Fatalf("expected the email to stay reserved")
+	}
+	if err := repos.Users.Restore(u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Users.GetById(u.Id); err != nil {
+		t.Fatalf("expected the user to be restored: %s", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	repos := memory.NewRepositories()
+	u := newTestUser(t, repos, "alice")
+	other := newTestUser(t, repos, "bob")
+	repos.AccessTokens.Create(domain.NewAccessToken("token", u.Id, 3600, time.Now()))
+	repos.AccessTokens.Create(domain.NewAccessToken("other", other.Id, 3600, time.Now()))
+	repos.SignupVerifications.Create(domain.NewUserSignupVerification("usv", u.Id, 3600, time.Now()))
+
+	if err := Purge(repos, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := repos.Users.IsEmailUsed(u.Email); used {
+		t.Fatalf("expected the email to be released")
+	}
+	if _, err := repos.AccessTokens.GetById("token"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the token to be removed, got %v", err)
+	}
+	if _, err := repos.SignupVerifications.GetById("usv"); !errors.Is(err, dao.ErrNotFound) {
+		t.Fatalf("expected the verification to be removed, got %v", err)
+	}
+	if _, err := repos.AccessTokens.GetById("other"); err != nil {
+		t.Fatalf("expected the tokens of the other users to be kept: %s", err)
+	}
+}
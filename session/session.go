@@ -0,0 +1,127 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/jeremyletang/babakoto_api/domain"
+)
+
+const (
+	defaultCookieName     = "babakoto_session"
+	defaultCsrfCookieName = "babakoto_csrf"
+	defaultCsrfHeader     = "X-CSRF-Token"
+)
+
+// Config of the cookie based sessions for browsers, when enabled the login
+// can store the access token in a HttpOnly cookie instead of returning it
+// to the javascript application. Requests authenticated by the cookie must
+// send back the csrf cookie value in the csrf header (double submit cookie).
+type Config struct {
+	Enabled        bool   `json:"enabled"`
+	CookieName     string `json:"cookie_name"`
+	CsrfCookieName string `json:"csrf_cookie_name"`
+	CsrfHeader     string `json:"csrf_header"`
+	Domain         string `json:"domain"`
+	// strict or lax, default to lax
+	SameSite string `json:"same_site"`
+	// only for local development over plain http
+	Insecure bool `json:"insecure"`
+}
+
+func (c Config) cookieName() string {
+	if c.CookieName == "" {
+		return defaultCookieName
+	}
+	return c.CookieName
+}
+
+func (c Config) csrfCookieName() string {
+	if c.CsrfCookieName == "" {
+		return defaultCsrfCookieName
+	}
+	return c.CsrfCookieName
+}
+
+func (c Config) csrfHeader() string {
+	if c.CsrfHeader == "" {
+		return defaultCsrfHeader
+	}
+	return c.CsrfHeader
+}
+
+func (c Config) sameSite() http.SameSite {
+	if strings.ToLower(c.SameSite) == "strict" {
+		return http.SameSiteStrictMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func (c Config) cookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   !c.Insecure,
+		SameSite: c.sameSite(),
+	}
+}
+
+func generateCsrfToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetCookies write the session cookie for the access token and a new csrf
+// cookie, the csrf token is returned so it can be sent in the response body
+func SetCookies(w http.ResponseWriter, c Config, at domain.AccessToken) (string, error) {
+	csrfToken, err := generateCsrfToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, c.cookie(c.cookieName(), at.Id, at.Ttl, true))
+	// readable by the javascript application so it can copy it in the header
+	http.SetCookie(w, c.cookie(c.csrfCookieName(), csrfToken, at.Ttl, false))
+	return csrfToken, nil
+}
+
+func ClearCookies(w http.ResponseWriter, c Config) {
+	http.SetCookie(w, c.cookie(c.cookieName(), "", -1, true))
+	http.SetCookie(w, c.cookie(c.csrfCookieName(), "", -1, false))
+}
+
+// GetToken return the access token id from the session cookie
+func GetToken(r *http.Request, c Config) (string, bool) {
+	cookie, err := r.Cookie(c.cookieName())
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// CheckCsrf verify that state changing requests send the csrf header
+// matching the csrf cookie
+func CheckCsrf(r *http.Request, c Config) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	cookie, err := r.Cookie(c.csrfCookieName())
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(c.csrfHeader())
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
@@ -4,4 +4,5 @@ const (
 	MissingFieldError   = "Missing field"
 	MailAlreadyUsed     = "This email is already used by another user"
 	UsernameAlreadyUsed = "This username is already used by another user"
+	InvalidPassword     = "Invalid password"
 )
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jeremyletang/babakoto_api/dao"
+	"github.com/jeremyletang/babakoto_api/jsend"
+)
+
+// ResponseError is an error which write its own response, e.g the failures
+// of the authentication
+type ResponseError interface {
+	error
+	Write(w http.ResponseWriter)
+}
+
+// WriteError answer with the status matching the kind of err, so every
+// handler report the same failure the same way. The details of the
+// unexpected errors are not sent to the client, log them before.
+func WriteError(w http.ResponseWriter, err error) {
+	var re ResponseError
+	switch {
+	case errors.As(err, &re):
+		re.Write(w)
+	case errors.Is(err, dao.ErrNotFound):
+		WriteJsonResponse(w, http.StatusNotFound, jsend.Fail("not found"))
+	case errors.Is(err, dao.ErrConflict):
+		WriteJsonResponse(w, http.StatusConflict, jsend.Fail("already exists"))
+	case errors.Is(err, dao.ErrStale):
+		WriteJsonResponse(w, http.StatusConflict, jsend.Fail("modified by another request"))
+	case errors.Is(err, dao.ErrUnavailable):
+		// the client can retry
+		w.Header().Set("Retry-After", "5")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsend.Error("service unavailable"))
+	default:
+		WriteJsonResponse(w, http.StatusInternalServerError, jsend.Error("internal error"))
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jeremyletang/babakoto_api/jsend"
+)
+
+// ETag of a resource at version, strong as every write change the version
+func ETag(version int) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// CheckIfMatch compare the If-Match header of r with the current version of
+// the resource and answer 412 if none match. Without header the request is
+// allowed, the update is still conditional on the version read.
+func CheckIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || header == "*" {
+		return true
+	}
+	// weak tags never match, the comparison is strong
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == ETag(version) {
+			return true
+		}
+	}
+	w.Header().Set("ETag", ETag(version))
+	WriteJsonResponse(w, http.StatusPreconditionFailed, jsend.Fail("the resource does not match If-Match"))
+	return false
+}
@@ -6,7 +6,19 @@ import (
 	"net/http"
 )
 
+// RequestIdentifier is implemented by the response writers which know the
+// id of the request they answer
+type RequestIdentifier interface {
+	RequestId() string
+}
+
 func WriteJsonResponse(w http.ResponseWriter, status int, body interface{}) {
+	// echo the request id in the jsend responses
+	if ri, ok := w.(RequestIdentifier); ok && ri.RequestId() != "" {
+		if jsend, ok := body.(map[string]interface{}); ok {
+			jsend["request_id"] = ri.RequestId()
+		}
+	}
 	rawBody, _ := json.Marshal(body)
 	WriteResponse(w, status, string(rawBody))
 }